@@ -3,23 +3,26 @@ package main
 import (
 	"client/config"
 	"client/pkg/core"
+	"client/pkg/update"
 	"common"
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"net/rpc"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
-// ClientRPC handles Server -> Client calls
-type ClientRPC struct{}
-
 // App struct
 type App struct {
 	ctx        context.Context
-	isLoggedIn bool
+	isLoggedIn atomic.Bool
+
+	// The rollback check of a fresh update runs with the first connect attempt
+	updateCheck sync.Once
 }
 
 // NewApp creates a new App application struct
@@ -40,16 +43,43 @@ func (a *App) startup(ctx context.Context) {
 		runtime.EventsEmit(a.ctx, "state-update", status)
 	}
 
-	// Register RPC handler
-	core.OnReverseRPC = func(server *rpc.Server, conn net.Conn) {
-		server.RegisterName("ClientRPC", &ClientRPC{})
-		server.ServeConn(conn)
+	// Load identity and user-approved allowlist, surface refused dials
+	core.State.Lock.Lock()
+	core.State.ClientID = config.EnsureClientID()
+	cfg := config.Get()
+	core.State.Allowlist = cfg.Allowlist
+	core.State.Approved = core.TargetSet(cfg.ApprovedTargets)
+	core.State.Lock.Unlock()
+
+	core.OnRejected = func(attempt core.RejectedAttempt) {
+		runtime.EventsEmit(a.ctx, "dial-rejected", attempt)
 	}
 
-	// Don't start connection loop automatically
+	// A freshly installed update must connect, or it is rolled back
+	core.OnConnected = update.Confirm
+
+	// Don't start connection loop automatically, except right after an update
+	// restarted us: waiting for the Login button would roll back a good build
+	if user := config.Get().User; update.Pending() && user.Name != "" {
+		go a.resumeAfterUpdate()
+	}
 	// go a.startConnectionLoop()
 }
 
+// resumeAfterUpdate logs in with the saved user info. A failed first connect
+// is retried like a dropped connection; the rollback timer decides.
+func (a *App) resumeAfterUpdate() {
+	user := config.Get().User
+	fmt.Println("Restarted by an update, connecting as", user.Name)
+	if err := a.Login(user.Name, user.Phone, user.ProjectName, user.Remark); err != nil {
+		a.isLoggedIn.Store(true)
+		go a.startConnectionLoop()
+	}
+	if core.OnUpdate != nil {
+		core.OnUpdate()
+	}
+}
+
 // Login sets the user info and attempts to connect
 func (a *App) Login(name, phone, projectName, remark string) error {
 	core.State.Lock.Lock()
@@ -59,7 +89,10 @@ func (a *App) Login(name, phone, projectName, remark string) error {
 	core.State.Remark = remark
 	core.State.Lock.Unlock()
 
-	serverAddr := config.GlobalConfig.ServerAddr
+	// Counts as a start of a fresh update, see update.CheckPending
+	a.updateCheck.Do(update.CheckPending)
+
+	serverAddr := config.Get().ServerAddr
 	fmt.Println("Login: Connecting to", serverAddr)
 	err := core.ConnectServer(serverAddr)
 	if err != nil {
@@ -70,7 +103,7 @@ func (a *App) Login(name, phone, projectName, remark string) error {
 	// Save user info
 	config.Save(name, phone, projectName, remark)
 
-	a.isLoggedIn = true
+	a.isLoggedIn.Store(true)
 	// Start the KeepAlive/Reconnection loop
 	go a.startConnectionLoop()
 
@@ -78,42 +111,12 @@ func (a *App) Login(name, phone, projectName, remark string) error {
 }
 
 func (a *App) startConnectionLoop() {
-	serverAddr := config.GlobalConfig.ServerAddr
-	ticker := time.NewTicker(5 * time.Second)
-	// Don't stop ticker, we loop forever
-
-	for {
-		<-ticker.C
-		if !a.isLoggedIn {
-			// If logged out (future feature), stop loop
-			continue
-		}
-		a.connect(serverAddr)
+	core.OnConnectResult = func(err error) {
+		runtime.EventsEmit(a.ctx, "connection-state", err == nil)
 	}
-}
 
-func (a *App) connect(addr string) {
-	core.State.Lock.RLock()
-	connected := core.State.IsConnected
-	core.State.Lock.RUnlock()
-
-	if connected {
-		return
-	}
-
-	fmt.Println("Connecting to", addr)
-	err := core.ConnectServer(addr)
-	if err != nil {
-		fmt.Printf("Connect failed: %v\n", err)
-		runtime.EventsEmit(a.ctx, "connection-state", false)
-	} else {
-		fmt.Println("Connected!")
-		runtime.EventsEmit(a.ctx, "connection-state", true)
-
-		// Trigger config sync?
-		// We should probably sync our local services to server if we have any.
-		// For now, let's assume services are in core.State.Services
-	}
+	// Loop forever (no stop channel until logout exists)
+	core.RunConnectionLoop(nil)
 }
 
 // Greet returns a greeting for the given name
@@ -123,24 +126,40 @@ func (a *App) Greet(name string) string {
 
 // GetStatus returns the current connection status
 func (a *App) GetStatus() map[string]interface{} {
+	cfg := config.Get()
 	core.State.Lock.RLock()
 	defer core.State.Lock.RUnlock()
 	return map[string]interface{}{
-		"connected": core.State.IsConnected,
-		"client_id": core.State.ClientID,
-		"server":    config.GlobalConfig.ServerAddr,
-		"services":  core.State.Services,
+		"connected":      core.State.IsConnected,
+		"logged_in":      a.isLoggedIn.Load(),
+		"client_id":      core.State.ClientID,
+		"server":         cfg.ServerAddr,
+		"services":       core.State.Services,
+		"allowlist":      core.State.Allowlist,
+		"unapproved":     core.UnapprovedServices(), // Service IDs the server set up, not yet approved
+		"rejected":       core.State.Rejected,
+		"rtt_ms":         core.State.LastRTT.Milliseconds(),
+		"last_seen":      core.State.LastSeen,
+		"missed_beats":   core.State.MissedBeats,
+		"version":        common.Version,
+		"server_version": core.State.ServerVersion,
+		"capabilities":   core.State.Capabilities,
+		"upgrade_notice": core.State.UpgradeNotice,
+		"update":         core.State.AvailableUpdate,
+		// Why an operator disconnected us; reconnecting waits for Reconnect
+		"disconnect_reason": core.State.DisconnectReason,
+		"reconnect_paused":  core.State.ReconnectPaused,
 		"user": map[string]string{
-			"name":         config.GlobalConfig.User.Name,
-			"phone":        config.GlobalConfig.User.Phone,
-			"project_name": config.GlobalConfig.User.ProjectName,
-			"remark":       config.GlobalConfig.User.Remark,
+			"name":         cfg.User.Name,
+			"phone":        cfg.User.Phone,
+			"project_name": cfg.User.ProjectName,
+			"remark":       cfg.User.Remark,
 		},
 	}
 }
 
 // AddTarget adds a new target service locally (and syncs to server)
-func (a *App) AddTarget(localIP string, localPort int, remotePort int, remark string) string {
+func (a *App) AddTarget(localIP string, localPort int, remotePort int, remark string, protocol string) string {
 	// 1. Create Service
 	// Generate unique ID to avoid collision if RemotePort is 0
 	svcID := fmt.Sprintf("%s-%d-%d", localIP, localPort, time.Now().UnixNano())
@@ -150,88 +169,150 @@ func (a *App) AddTarget(localIP string, localPort int, remotePort int, remark st
 		LocalPort:  localPort,
 		RemotePort: remotePort,
 		Remark:     remark,
+		Protocol:   protocol,
 	}
 
-	// 2. Add to Local State
-	core.State.Lock.Lock()
-	core.State.Services = append(core.State.Services, svc)
-	core.State.Lock.Unlock()
+	// 2. Add to Local State. The user chose this target, so the server may dial it
+	config.SaveApprovedTargets(core.ApproveServices(svc))
+	core.State.Lock.RLock()
+	services := append([]common.TargetService{}, core.State.Services...)
+	core.State.Lock.RUnlock()
+	core.SetServices(append(services, svc))
 
 	// 3. Sync to Server (if connected)
-	// We need to call SyncConfig RPC
-	// This requires access to RPCClient which is in Core State.
-	go func() {
-		core.State.Lock.RLock()
-		client := core.State.RPCClient
-		connected := core.State.IsConnected
-		myID := core.State.ClientID
-		// Copy services
-		currentServices := make([]common.TargetService, len(core.State.Services))
-		copy(currentServices, core.State.Services)
-		core.State.Lock.RUnlock()
-
-		if connected && client != nil {
-			args := &common.SyncConfigArgs{
-				ClientID: myID,
-				Services: currentServices, // Send full list
-			}
-
-			var reply common.BaseReply
-			client.Call("ServerRPCContext.SyncConfig", args, &reply)
-		}
-	}()
+	go core.SyncServices()
 
 	return "Added"
 }
 
+// UpdateTarget edits a target service in place (and syncs to server).
+// The public port stays; the server applies the new target to new connections.
+func (a *App) UpdateTarget(id string, localIP string, localPort int, remark string, protocol string) error {
+	core.State.Lock.RLock()
+	services := append([]common.TargetService{}, core.State.Services...)
+	core.State.Lock.RUnlock()
+
+	found := false
+	for i := range services {
+		if services[i].ID == id {
+			services[i].LocalIP = localIP
+			services[i].LocalPort = localPort
+			services[i].Remark = remark
+			services[i].Protocol = protocol
+			config.SaveApprovedTargets(core.ApproveServices(services[i]))
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("service %s not found", id)
+	}
+	core.SetServices(services)
+
+	go core.SyncServices()
+	return nil
+}
+
 // RemoveTarget removes a target service locally (and syncs to server)
 func (a *App) RemoveTarget(id string) string {
 	// 1. Remove from Local State
-	core.State.Lock.Lock()
+	core.State.Lock.RLock()
 	newServices := []common.TargetService{}
 	for _, s := range core.State.Services {
 		if s.ID != id {
 			newServices = append(newServices, s)
 		}
 	}
-	core.State.Services = newServices
-	core.State.Lock.Unlock()
+	core.State.Lock.RUnlock()
+	core.SetServices(newServices)
 
 	// 2. Sync to Server (if connected)
-	go func() {
-		core.State.Lock.RLock()
-		client := core.State.RPCClient
-		connected := core.State.IsConnected
-		myID := core.State.ClientID
-		// Copy services
-		currentServices := make([]common.TargetService, len(core.State.Services))
-		copy(currentServices, core.State.Services)
-		core.State.Lock.RUnlock()
-
-		if connected && client != nil {
-			args := &common.SyncConfigArgs{
-				ClientID: myID,
-				Services: currentServices, // Send full list
-			}
-
-			var reply common.BaseReply
-			client.Call("ServerRPCContext.SyncConfig", args, &reply)
-		}
-	}()
+	go core.SyncServices()
 
 	return "Removed"
 }
 
-// PushConfig updates local services from server
-func (r *ClientRPC) PushConfig(args *common.PushConfigArgs, reply *common.BaseReply) error {
-	core.State.Lock.Lock()
-	core.State.Services = args.Services
-	core.State.Lock.Unlock()
+// ApproveService lets the server dial the target of a service it set up
+func (a *App) ApproveService(id string) error {
+	core.State.Lock.RLock()
+	var svc common.TargetService
+	found := false
+	for _, s := range core.State.Services {
+		if s.ID == id {
+			svc, found = s, true
+		}
+	}
+	core.State.Lock.RUnlock()
+	if !found {
+		return fmt.Errorf("service %s not found", id)
+	}
 
+	config.SaveApprovedTargets(core.ApproveServices(svc))
 	if core.OnUpdate != nil {
 		core.OnUpdate()
 	}
+	// The server shows the service as pending until it hears otherwise
+	go core.SyncServices()
+	return nil
+}
+
+// AddAllowRule approves a CIDR (or single IP) and optional ports for server-initiated dials
+func (a *App) AddAllowRule(cidr string, ports []int) error {
+	if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+		return fmt.Errorf("invalid CIDR or IP: %s", cidr)
+	}
+	for _, p := range ports {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid port: %d", p)
+		}
+	}
 
-	reply.Success = true
+	core.State.Lock.Lock()
+	rules := append([]config.AllowRule{}, core.State.Allowlist...)
+	rules = append(rules, config.AllowRule{CIDR: cidr, Ports: ports})
+	core.State.Allowlist = rules
+	core.State.Lock.Unlock()
+
+	config.SaveAllowlist(rules)
+	return nil
+}
+
+// RemoveAllowRule deletes the allowlist rule at index
+func (a *App) RemoveAllowRule(index int) error {
+	core.State.Lock.Lock()
+	if index < 0 || index >= len(core.State.Allowlist) {
+		core.State.Lock.Unlock()
+		return fmt.Errorf("no allowlist rule at index %d", index)
+	}
+	rules := append([]config.AllowRule{}, core.State.Allowlist[:index]...)
+	rules = append(rules, core.State.Allowlist[index+1:]...)
+	core.State.Allowlist = rules
+	core.State.Lock.Unlock()
+
+	config.SaveAllowlist(rules)
 	return nil
 }
+
+// Reconnect resumes connecting after an operator disconnected us
+func (a *App) Reconnect() error {
+	core.Resume()
+	return core.ConnectServer(config.Get().ServerAddr)
+}
+
+// ApplyUpdate downloads and installs the build the server offered, then restarts into it
+func (a *App) ApplyUpdate() error {
+	core.State.Lock.RLock()
+	info := core.State.AvailableUpdate
+	peer := core.State.Peer
+	core.State.Lock.RUnlock()
+	if info == nil || peer == nil {
+		return errors.New("no update available")
+	}
+
+	ctx, cancel := context.WithTimeout(a.ctx, 10*time.Minute)
+	defer cancel()
+	if err := update.Apply(ctx, peer, info); err != nil {
+		return err
+	}
+	core.Disconnect()
+	return update.Restart()
+}
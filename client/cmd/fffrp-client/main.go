@@ -0,0 +1,239 @@
+// Command fffrp-client is the headless client for jump boxes without a desktop.
+// It shares config and core with the Wails app, reconnects forever and is
+// meant to run under systemd (see fffrp-client.service).
+//
+// Signals: SIGINT/SIGTERM shut down gracefully, SIGHUP reloads the config
+// file (user info, services, allowlist) and reopens the log file, SIGUSR1
+// installs the update offered by the server (update.auto does it on connect).
+package main
+
+import (
+	"client/config"
+	"client/pkg/core"
+	rpcHandler "client/pkg/rpc"
+	"client/pkg/update"
+	"common"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	configPath = flag.String("config", "config.yaml", "config file")
+	logPath    = flag.String("log", "", "also write logs to this file")
+	serverAddr = flag.String("server", "", "server address, overrides server_addr")
+	token      = flag.String("token", "", "auth token, overrides token")
+	name       = flag.String("name", "", "user name, overrides user.name")
+	phone      = flag.String("phone", "", "phone, overrides user.phone")
+	project    = flag.String("project", "", "project name, overrides user.project_name")
+	remark     = flag.String("remark", "", "remark, overrides user.remark")
+)
+
+var logFile *os.File
+
+func main() {
+	flag.Parse()
+
+	if err := openLog(); err != nil {
+		log.Fatalf("Failed to open log file: %v", err)
+	}
+
+	// 1. Load Config
+	config.Path = *configPath
+	loadConfig()
+
+	user := config.Get().User
+	if user.Name == "" || user.Phone == "" || user.ProjectName == "" {
+		log.Fatal("name, phone and project name are required (config.yaml user section or -name/-phone/-project)")
+	}
+
+	// 2. Serve Server -> Client calls on every control stream
+	core.OnPeer = rpcHandler.Register
+
+	// A freshly installed update must connect, or it is rolled back
+	update.CheckPending()
+	core.OnConnected = func() {
+		update.Confirm()
+		if config.Get().Update.Auto {
+			go applyUpdate()
+		}
+	}
+
+	// 3. Connect, then keep reconnecting forever
+	stop := make(chan struct{})
+	go func() {
+		addr := config.Get().ServerAddr
+		log.Println("Connecting to", addr)
+		if err := core.ConnectServer(addr); err != nil {
+			log.Printf("Connect failed: %v (will retry)", err)
+		}
+		core.RunConnectionLoop(stop)
+	}()
+
+	// 4. Handle signals
+	signals := make(chan os.Signal, 1)
+	watched := []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+	if updateSignal != nil {
+		watched = append(watched, updateSignal)
+	}
+	signal.Notify(signals, watched...)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			log.Println("SIGHUP received, reloading config")
+			reload()
+			continue
+		}
+		if updateSignal != nil && sig == updateSignal {
+			log.Printf("%v received, installing update", sig)
+			go applyUpdate()
+			continue
+		}
+
+		log.Printf("%v received, shutting down", sig)
+		close(stop)
+		core.Disconnect()
+		if logFile != nil {
+			logFile.Close()
+		}
+		return
+	}
+}
+
+// applyFlags puts command-line settings over the config file, in memory only
+func applyFlags(c *config.Config) {
+	if *serverAddr != "" {
+		c.ServerAddr = *serverAddr
+	}
+	if *token != "" {
+		c.Token = *token
+	}
+	user := &c.User
+	for _, o := range []struct {
+		flag  string
+		field *string
+	}{{*name, &user.Name}, {*phone, &user.Phone}, {*project, &user.ProjectName}, {*remark, &user.Remark}} {
+		if o.flag != "" {
+			*o.field = o.flag
+		}
+	}
+}
+
+// loadConfig reads the config file and applies flags and state on top of it
+func loadConfig() {
+	config.Overrides = applyFlags
+	config.Load()
+	cfg := config.Get()
+	user := cfg.User
+
+	core.State.Lock.Lock()
+	core.State.ClientID = config.EnsureClientID()
+	core.State.Name = user.Name
+	core.State.Phone = user.Phone
+	core.State.ProjectName = user.ProjectName
+	core.State.Remark = user.Remark
+	core.State.Allowlist = cfg.Allowlist
+	core.State.Approved = core.TargetSet(cfg.ApprovedTargets)
+	core.State.Lock.Unlock()
+
+	// Services from YAML are authoritative. Without any, keep what the server stored for us.
+	// Their targets are ours, services the server adds need approved_targets or the allowlist.
+	if len(cfg.Services) > 0 {
+		services := make([]common.TargetService, len(cfg.Services))
+		for i, svc := range cfg.Services {
+			// Derive a stable ID so the server can restore the same public port
+			if svc.ID == "" {
+				svc.ID = fmt.Sprintf("%s-%d", svc.LocalIP, svc.LocalPort)
+				if svc.Proto() != common.ProtocolTCP {
+					svc.ID += "-" + svc.Proto()
+				}
+			}
+			services[i] = svc
+		}
+		core.ApproveServices(services...)
+		core.SetServices(services)
+	}
+}
+
+// reload re-reads the config. Services are resynced in place; a changed
+// server, token or identity needs a new session, so we disconnect and let
+// the connection loop reconnect.
+func reload() {
+	if err := openLog(); err != nil {
+		log.Printf("Failed to reopen log file: %v", err)
+	}
+
+	old := config.Get()
+	loadConfig()
+	cur := config.Get()
+
+	// Also the way to reconnect after an operator disconnected us
+	core.Resume()
+
+	if old.ServerAddr != cur.ServerAddr || old.Token != cur.Token || old.TLS != cur.TLS || old.User != cur.User {
+		log.Println("Connection settings changed, reconnecting")
+		core.Disconnect()
+		return
+	}
+	if err := core.SyncServices(); err != nil {
+		log.Printf("Service sync after reload failed: %v", err)
+	}
+}
+
+// openLog (re)opens the -log file so logrotate can move it away
+func openLog() error {
+	if *logPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(io.MultiWriter(os.Stdout, f))
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+	return nil
+}
+
+// updateLock keeps auto-update and SIGUSR1 from installing twice
+var updateLock sync.Mutex
+
+// applyUpdate installs the build the server offered, if any, and re-execs into it
+func applyUpdate() {
+	if !updateLock.TryLock() {
+		return
+	}
+	defer updateLock.Unlock()
+
+	core.State.Lock.RLock()
+	info := core.State.AvailableUpdate
+	peer := core.State.Peer
+	core.State.Lock.RUnlock()
+	if info == nil || peer == nil {
+		log.Println("No update offered by the server")
+		return
+	}
+
+	log.Printf("Installing update %s", info.Version)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	if err := update.Apply(ctx, peer, info); err != nil {
+		log.Printf("Update failed: %v", err)
+		return
+	}
+	core.Disconnect()
+	if logFile != nil {
+		logFile.Close()
+	}
+	if err := update.Restart(); err != nil {
+		log.Fatalf("Update installed, but restart failed: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// updateSignal asks the running client to install the offered update
+var updateSignal os.Signal = syscall.SIGUSR1
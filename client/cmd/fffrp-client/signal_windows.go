@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// updateSignal is unavailable on Windows, use update.auto instead
+var updateSignal os.Signal
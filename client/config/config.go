@@ -1,54 +1,207 @@
 package config
 
 import (
+	"common"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 
+	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	ServerAddr string `yaml:"server_addr"`
-	User       struct {
+	ClientID   string `yaml:"client_id"` // Stable identity, generated on first run
+	// Proves client_id to the server, generated with it. Copying both moves the identity.
+	ClientSecret string `yaml:"client_secret"`
+	Token        string `yaml:"token"` // Auth token sent in Handshake
+	User         struct {
 		Name        string `yaml:"name"`
 		Phone       string `yaml:"phone"`
 		ProjectName string `yaml:"project_name"`
 		Remark      string `yaml:"remark"`
 	} `yaml:"user"`
+	TLS struct {
+		Insecure    bool   `yaml:"insecure"`    // Plaintext TCP, lab use only
+		CAFile      string `yaml:"ca_file"`     // PEM CA bundle to verify the server
+		Fingerprint string `yaml:"fingerprint"` // SHA-256 of the server certificate (hex), overrides ca_file
+		ServerName  string `yaml:"server_name"` // Defaults to host of server_addr
+	} `yaml:"tls"`
+	Allowlist []AllowRule `yaml:"allowlist"` // LAN targets the server may reach besides configured services
+	// Service targets the user created or approved in the UI ("tcp/192.168.1.10:22").
+	// Services the server pushed are only dialed if listed here or allowlisted.
+	ApprovedTargets []string `yaml:"approved_targets,omitempty"`
+	// Set once approvals were first saved. Until then the services the server
+	// stored for us predate approvals and are approved on the first push.
+	ApprovalsSaved bool `yaml:"approvals_saved,omitempty"`
+	// Services exposed on connect, used by the headless client (Wails keeps them in memory)
+	Services  []common.TargetService `yaml:"services,omitempty"`
+	Heartbeat struct {
+		IntervalSeconds int `yaml:"interval_seconds"` // Default 5
+		MaxMissed       int `yaml:"max_missed"`       // Reconnect after this many missed beats, default 3
+	} `yaml:"heartbeat"`
+	Update struct {
+		PublicKey string `yaml:"public_key,omitempty"` // Base64 ed25519 key for signed builds, if not built in
+		Auto      bool   `yaml:"auto,omitempty"`       // Headless: install offered updates without asking
+	} `yaml:"update,omitempty"`
 }
 
-var GlobalConfig Config
+// AllowRule permits dialing addresses in CIDR (or a single IP) on the listed ports
+type AllowRule struct {
+	CIDR  string `yaml:"cidr" json:"cidr"`
+	Ports []int  `yaml:"ports" json:"ports"` // Empty means any port
+}
+
+var (
+	// current is replaced as a whole, never changed in place, so a reader
+	// holding it keeps a consistent view while a reload runs
+	current atomic.Pointer[Config]
+	// Serializes Load and save, which both derive the next config from disk
+	lock sync.Mutex
+)
+
+// Path is the config file, overridable by the headless client's -config flag
+var Path = "config.yaml"
+
+// Overrides, if set, is applied on every Load in memory only (the headless
+// client's command-line flags)
+var Overrides func(c *Config)
+
+// Get returns the current config. It must not be modified; take it once
+// and read every field from that one snapshot.
+func Get() *Config {
+	if c := current.Load(); c != nil {
+		return c
+	}
+	c := defaults()
+	return &c
+}
 
 func Load() {
-	// Default
-	GlobalConfig.ServerAddr = "120.27.217.221:7001"
+	lock.Lock()
+	defer lock.Unlock()
 
-	data, err := os.ReadFile("config.yaml")
+	// Default (start from scratch so a reload drops removed keys)
+	cfg := defaults()
+	defer func() {
+		if Overrides != nil {
+			Overrides(&cfg)
+		}
+		current.Store(&cfg)
+	}()
+
+	data, err := os.ReadFile(Path)
 	if err != nil {
-		log.Println("config.yaml not found, using defaults")
+		log.Printf("%s not found, using defaults", Path)
 		return
 	}
 
-	err = yaml.Unmarshal(data, &GlobalConfig)
+	err = yaml.Unmarshal(data, &cfg)
 	if err != nil {
-		log.Printf("Failed to parse config.yaml: %v", err)
+		log.Printf("Failed to parse %s: %v", Path, err)
+	}
+
+	// Holds the token and client secret: older versions wrote it world-readable
+	if info, err := os.Stat(Path); err == nil && info.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(Path, 0600); err != nil {
+			log.Printf("Failed to restrict permissions of %s: %v", Path, err)
+		}
 	}
 }
 
+func defaults() Config {
+	c := Config{}
+	c.ServerAddr = "120.27.217.221:7001"
+	c.Heartbeat.IntervalSeconds = 5
+	c.Heartbeat.MaxMissed = 3
+	return c
+}
+
 func Save(name, phone, projectName, remark string) {
-	GlobalConfig.User.Name = name
-	GlobalConfig.User.Phone = phone
-	GlobalConfig.User.ProjectName = projectName
-	GlobalConfig.User.Remark = remark
+	save(func(c *Config) {
+		c.User.Name = name
+		c.User.Phone = phone
+		c.User.ProjectName = projectName
+		c.User.Remark = remark
+	})
+}
+
+// EnsureClientID returns the persistent client identity, generating and saving it
+// (and the secret proving it) on first run
+func EnsureClientID() string {
+	cfg := Get()
+	id, secret := cfg.ClientID, cfg.ClientSecret
+	if id == "" {
+		id = uuid.NewString()
+		log.Printf("Generated new client ID %s", id)
+	}
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			log.Printf("Failed to generate client secret: %v", err)
+		} else {
+			secret = hex.EncodeToString(buf)
+		}
+	}
+	if id != cfg.ClientID || secret != cfg.ClientSecret {
+		save(func(c *Config) {
+			c.ClientID = id
+			c.ClientSecret = secret
+		})
+	}
+	return Get().ClientID
+}
+
+// SaveAllowlist persists the user-approved target allowlist
+func SaveAllowlist(rules []AllowRule) {
+	save(func(c *Config) { c.Allowlist = rules })
+}
+
+// SaveApprovedTargets persists the service targets the user approved
+func SaveApprovedTargets(targets []string) {
+	save(func(c *Config) {
+		c.ApprovedTargets = targets
+		c.ApprovalsSaved = true
+	})
+}
+
+// SaveFingerprint pins the server certificate (trust on first use)
+func SaveFingerprint(fp string) {
+	save(func(c *Config) { c.TLS.Fingerprint = fp })
+}
+
+// save applies change to the current config and to the file. The file is re-read
+// first, so settings only given on the command line are never written to it.
+func save(change func(c *Config)) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	cfg := *Get()
+	change(&cfg)
+	current.Store(&cfg)
+
+	onDisk := defaults()
+	if data, err := os.ReadFile(Path); err == nil {
+		if err := yaml.Unmarshal(data, &onDisk); err != nil {
+			log.Printf("Not saving %s, it does not parse: %v", Path, err)
+			return
+		}
+	}
+	change(&onDisk)
 
-	data, err := yaml.Marshal(&GlobalConfig)
+	data, err := yaml.Marshal(&onDisk)
 	if err != nil {
 		log.Printf("Failed to marshal config: %v", err)
 		return
 	}
 
-	err = os.WriteFile("config.yaml", data, 0644)
+	// Only the user may read the token and client secret
+	err = os.WriteFile(Path, data, 0600)
 	if err != nil {
-		log.Printf("Failed to save config.yaml: %v", err)
+		log.Printf("Failed to save %s: %v", Path, err)
 	}
 }
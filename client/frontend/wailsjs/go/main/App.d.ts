@@ -2,8 +2,20 @@ export function Greet(arg1:string):Promise<string>;
 
 export function GetStatus():Promise<any>;
 
-export function AddTarget(arg1:string, arg2:number, arg3:number, arg4:string):Promise<string>;
+export function AddTarget(arg1:string, arg2:number, arg3:number, arg4:string, arg5:string):Promise<string>;
 
 export function RemoveTarget(arg1:string):Promise<string>;
 
 export function Login(arg1:string, arg2:string, arg3:string, arg4:string):Promise<void>;
+
+export function AddAllowRule(arg1:string, arg2:Array<number>):Promise<void>;
+
+export function RemoveAllowRule(arg1:number):Promise<void>;
+
+export function ApplyUpdate():Promise<void>;
+
+export function Reconnect():Promise<void>;
+
+export function UpdateTarget(arg1:string, arg2:string, arg3:number, arg4:string, arg5:string):Promise<void>;
+
+export function ApproveService(arg1:string):Promise<void>;
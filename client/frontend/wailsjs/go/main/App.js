@@ -6,8 +6,8 @@ export function GetStatus() {
   return window['go']['main']['App']['GetStatus']();
 }
 
-export function AddTarget(arg1, arg2, arg3, arg4) {
-  return window['go']['main']['App']['AddTarget'](arg1, arg2, arg3, arg4);
+export function AddTarget(arg1, arg2, arg3, arg4, arg5) {
+  return window['go']['main']['App']['AddTarget'](arg1, arg2, arg3, arg4, arg5);
 }
 
 export function RemoveTarget(arg1) {
@@ -17,3 +17,27 @@ export function RemoveTarget(arg1) {
 export function Login(arg1, arg2, arg3, arg4) {
   return window['go']['main']['App']['Login'](arg1, arg2, arg3, arg4);
 }
+
+export function AddAllowRule(arg1, arg2) {
+  return window['go']['main']['App']['AddAllowRule'](arg1, arg2);
+}
+
+export function RemoveAllowRule(arg1) {
+  return window['go']['main']['App']['RemoveAllowRule'](arg1);
+}
+
+export function ApplyUpdate() {
+  return window['go']['main']['App']['ApplyUpdate']();
+}
+
+export function Reconnect() {
+  return window['go']['main']['App']['Reconnect']();
+}
+
+export function UpdateTarget(arg1, arg2, arg3, arg4, arg5) {
+  return window['go']['main']['App']['UpdateTarget'](arg1, arg2, arg3, arg4, arg5);
+}
+
+export function ApproveService(arg1) {
+  return window['go']['main']['App']['ApproveService'](arg1);
+}
@@ -5,8 +5,6 @@ import (
 	"client/pkg/core"
 	rpcHandler "client/pkg/rpc"
 	"embed"
-	"net"
-	"net/rpc"
 
 	"github.com/wailsapp/wails/v2"
 	"github.com/wailsapp/wails/v2/pkg/options"
@@ -20,11 +18,8 @@ func main() {
 	// 1. Load Config
 	config.Load()
 
-	// 2. Setup Reverse RPC Hook
-	core.OnReverseRPC = func(server *rpc.Server, conn net.Conn) {
-		server.Register(new(rpcHandler.ClientRPC))
-		server.ServeConn(conn)
-	}
+	// 2. Serve Server -> Client calls on every control stream
+	core.OnPeer = rpcHandler.Register
 
 	// 3. Create App instance
 	app := NewApp()
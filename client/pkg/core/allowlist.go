@@ -0,0 +1,210 @@
+package core
+
+import (
+	"client/config"
+	"common"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxRejected caps the rejected-attempt history shown in the UI
+const maxRejected = 50
+
+// RejectedAttempt records a data stream the client refused to dial
+type RejectedAttempt struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Reason string    `json:"reason"`
+}
+
+// OnRejected is called when a dial request from the server is refused
+var OnRejected func(RejectedAttempt)
+
+// TargetKey identifies a service target for approval, e.g. "tcp/192.168.1.10:22"
+func TargetKey(svc common.TargetService) string {
+	return svc.Proto() + "/" + net.JoinHostPort(svc.LocalIP, strconv.Itoa(svc.LocalPort))
+}
+
+// TargetSet turns persisted approved targets into the lookup kept in State.Approved
+func TargetSet(targets []string) map[string]bool {
+	set := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		set[t] = true
+	}
+	return set
+}
+
+// ApproveServices marks the targets of services as chosen by the user,
+// so the server may dial them. Returns all approved targets for persisting.
+func ApproveServices(services ...common.TargetService) []string {
+	State.Lock.Lock()
+	if State.Approved == nil {
+		State.Approved = make(map[string]bool)
+	}
+	for _, svc := range services {
+		State.Approved[TargetKey(svc)] = true
+	}
+	targets := make([]string, 0, len(State.Approved))
+	for t := range State.Approved {
+		targets = append(targets, t)
+	}
+	State.Lock.Unlock()
+
+	sort.Strings(targets)
+	return targets
+}
+
+// UnapprovedServices returns the IDs of services the server set up whose
+// target the user has neither approved nor allowlisted.
+// Caller must hold State.Lock.
+func UnapprovedServices() []string {
+	ids := []string{}
+	for _, svc := range State.Services {
+		if State.Approved[TargetKey(svc)] {
+			continue
+		}
+		if ip := net.ParseIP(svc.LocalIP); ip != nil && ruleAllows(State.Allowlist, ip, svc.LocalPort) {
+			continue
+		}
+		ids = append(ids, svc.ID)
+	}
+	return ids
+}
+
+// ApplyPushedServices takes the service list the server pushed and returns
+// the IDs still waiting for approval. The first push after upgrading to a
+// client with approvals carries services set up before approvals existed;
+// those are approved once, so forwarding that worked keeps working.
+func ApplyPushedServices(services []common.TargetService) []string {
+	State.Lock.RLock()
+	before := UnapprovedServices()
+	State.Lock.RUnlock()
+
+	if !config.Get().ApprovalsSaved {
+		log.Printf("[Core] Approving %d services stored on the server before approvals existed", len(services))
+		config.SaveApprovedTargets(ApproveServices(services...))
+	}
+	SetServices(services)
+
+	State.Lock.RLock()
+	pending := UnapprovedServices()
+	var targets []string
+	for _, svc := range State.Services {
+		if slices.Contains(pending, svc.ID) {
+			targets = append(targets, TargetKey(svc))
+		}
+	}
+	State.Lock.RUnlock()
+
+	if len(pending) > 0 {
+		log.Printf("[Core] Services %v from the server need approval: approve them in the UI, or add %v to approved_targets and reload", pending, targets)
+	}
+	// Tell the server what is pending, a push sent as a notification has no reply to carry it
+	if !slices.Equal(before, pending) {
+		go SyncServices()
+	}
+	return pending
+}
+
+// checkTarget decides whether the server may make us dial addr.
+// Allowed are exact matches of a service the user created or approved, or
+// addresses inside an allowlist rule. A service the server pushed is not
+// enough on its own, or a compromised server could push any LAN address.
+// Returns the address that should actually be dialed
+// (hostnames are resolved here so the checked IP is the one we connect to).
+func checkTarget(addr string, protocol string) (string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid target %q", addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in %q", addr)
+	}
+
+	State.Lock.RLock()
+	unapproved := "" // Matching service the server pushed, if any
+	for _, svc := range State.Services {
+		if svc.LocalIP == host && svc.LocalPort == port && svc.Proto() == protocol {
+			if State.Approved[TargetKey(svc)] {
+				State.Lock.RUnlock()
+				return addr, nil
+			}
+			unapproved = svc.ID
+		}
+	}
+	rules := State.Allowlist
+	State.Lock.RUnlock()
+
+	refused := fmt.Errorf("%s is not a configured service or in the allowlist", addr)
+	if unapproved != "" {
+		refused = fmt.Errorf("service %s (%s) was set up by the server and is not approved", unapproved, addr)
+	} else if len(rules) == 0 {
+		refused = fmt.Errorf("%s is not a configured service", addr)
+	}
+	if len(rules) == 0 {
+		return "", refused
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return "", fmt.Errorf("resolve %s: %v", host, err)
+		}
+	}
+
+	for _, ip := range ips {
+		if ruleAllows(rules, ip, port) {
+			return net.JoinHostPort(ip.String(), portStr), nil
+		}
+	}
+	return "", refused
+}
+
+func ruleAllows(rules []config.AllowRule, ip net.IP, port int) bool {
+	for _, rule := range rules {
+		_, network, err := net.ParseCIDR(rule.CIDR)
+		if err != nil {
+			// Allow a bare IP as shorthand for /32 or /128
+			single := net.ParseIP(rule.CIDR)
+			if single == nil || !single.Equal(ip) {
+				continue
+			}
+		} else if !network.Contains(ip) {
+			continue
+		}
+
+		if len(rule.Ports) == 0 {
+			return true
+		}
+		for _, p := range rule.Ports {
+			if p == port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recordRejected logs a refused dial and keeps it for the UI
+func recordRejected(target string, reason error) {
+	log.Printf("[Core] Rejected dial to %s: %v", target, reason)
+
+	attempt := RejectedAttempt{Time: time.Now(), Target: target, Reason: reason.Error()}
+	State.Lock.Lock()
+	State.Rejected = append(State.Rejected, attempt)
+	if len(State.Rejected) > maxRejected {
+		State.Rejected = State.Rejected[len(State.Rejected)-maxRejected:]
+	}
+	State.Lock.Unlock()
+
+	if OnRejected != nil {
+		OnRejected(attempt)
+	}
+}
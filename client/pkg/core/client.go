@@ -1,15 +1,17 @@
 package core
 
 import (
-	"bufio"
+	"client/config"
 	"common"
+	"common/jsonrpc"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/rpc"
-	"strings"
+	"runtime"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/yamux"
 )
@@ -18,11 +20,37 @@ import (
 type AppState struct {
 	ClientID    string
 	Session     *yamux.Session
-	RPCClient   *rpc.Client
+	Peer        *jsonrpc.Peer
 	Services    []common.TargetService
 	IsConnected bool
 	Lock        sync.RWMutex
 
+	// HasServiceList is false until the user edited services or the server sent us a list.
+	// Until then our (empty) list must not overwrite what the server stored for us.
+	HasServiceList bool
+
+	// Negotiated with the server in the handshake
+	ServerVersion string
+	Capabilities  []string
+	// UpgradeNotice is set when the server recommends upgrading this client
+	UpgradeNotice string
+	// AvailableUpdate is a signed build the server offers, nil if none
+	AvailableUpdate *common.UpdateInfo
+
+	// Set when an operator disconnected us; the connection loop waits for Resume
+	DisconnectReason string
+	ReconnectPaused  bool
+
+	// Link Health (from heartbeats)
+	LastRTT     time.Duration
+	LastSeen    time.Time
+	MissedBeats int
+
+	// Target Security
+	Allowlist []config.AllowRule
+	Approved  map[string]bool // Service targets the user created or approved, by TargetKey
+	Rejected  []RejectedAttempt
+
 	// User Info
 	Name        string
 	Phone       string
@@ -31,46 +59,75 @@ type AppState struct {
 }
 
 var State = &AppState{
-	// ClientID will be loaded from config or generated
+	// ClientID is loaded from config (config.EnsureClientID) before connecting
 }
 
 // OnUpdate is called when state changes
 var OnUpdate func()
 
-// ConnectServer establishes connection to the server
+// ConnectServer establishes connection to the server and resends our services
 func ConnectServer(addr string) error {
+	opened, err := openSession(addr)
+	if err != nil || !opened {
+		return err
+	}
+
+	// 8. Resync services so the server restores listeners and ports after a reconnect.
+	// Must run without State.Lock: the server pushes the merged list back to us.
+	if err := SyncServices(); err != nil {
+		log.Println("[Core] Service sync after connect failed:", err)
+	}
+
+	if OnConnected != nil {
+		OnConnected()
+	}
+	return nil
+}
+
+// OnConnected is called after every successful connect and sync
+var OnConnected func()
+
+// openSession dials the server and performs the handshake.
+// Returns false if we were already connected.
+func openSession(addr string) (bool, error) {
 	State.Lock.Lock()
 	defer State.Lock.Unlock()
 
 	if State.IsConnected {
-		return nil
+		return false, nil
 	}
 
-	conn, err := net.Dial("tcp", addr)
+	conn, err := dialServer(addr)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// 1. Setup Yamux Client
 	session, err := yamux.Client(conn, nil)
 	if err != nil {
 		conn.Close()
-		return err
+		return false, err
 	}
 	State.Session = session
 
-	// 2. Open Control Stream (Client -> Server)
+	// 2. Open Control Stream. JSON-RPC runs over it in both directions,
+	// every stream the server opens after it is a data stream.
 	controlStream, err := session.Open()
 	if err != nil {
 		session.Close()
-		return err
+		return false, err
 	}
 
-	// 3. Setup RPC Client
-	rpcClient := rpc.NewClient(controlStream)
-	State.RPCClient = rpcClient
+	// 3. Setup RPC Peer, with our handlers for Server -> Client calls
+	peer := jsonrpc.NewPeer(controlStream, common.Schemas)
+	if OnPeer != nil {
+		OnPeer(peer)
+	}
+	go peer.Run()
+	State.Peer = peer
 
 	// 4. Handshake
+	cfg := config.Get()
 	args := &common.HandshakeArgs{
 		ClientID:    State.ClientID,
 		Version:     common.Version,
@@ -78,65 +135,66 @@ func ConnectServer(addr string) error {
 		Phone:       State.Phone,
 		ProjectName: State.ProjectName,
 		Remark:      State.Remark,
+		Token:       cfg.Token,
+
+		ClientSecret: cfg.ClientSecret,
+
+		Capabilities: common.LocalCapabilities,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
 	}
-	var reply common.BaseReply
-	err = rpcClient.Call("ServerRPCContext.Handshake", args, &reply)
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	var reply common.HandshakeReply
+	err = peer.Call(ctx, common.MethodHandshake, args, &reply)
 	if err != nil {
 		session.Close()
-		return fmt.Errorf("handshake failed: %v", err)
+		return false, fmt.Errorf("handshake failed: %v", err)
 	}
 	if !reply.Success {
 		session.Close()
-		return fmt.Errorf("handshake rejected: %s", reply.Message)
+		return false, fmt.Errorf("handshake rejected: %s", reply.Message)
+	}
+	// Servers before negotiation send no list but frame their streams
+	if reply.Capabilities != nil && !common.HasCapability(reply.Capabilities, common.CapStreamHandshake) {
+		session.Close()
+		return false, fmt.Errorf("server %s does not speak data stream frame version %d, please upgrade the server", reply.ServerVersion, common.StreamFrameVersion)
 	}
 	log.Println("[Core] Handshake success:", reply.Message)
 
-	// 5. Accept Reverse Control Stream (Server -> Client)
-	// We need to do this asynchronously because `ConnectServer` might block the UI
-	// But we should ensure it's ready.
-	go func() {
-		// Expect Server to open a stream immediately after handshake (or parallel)
-		// Note: In our Server implementation, Server opens it right after Accept.
-		// So it should be waiting in queue.
-		revStream, err := session.Accept()
-		if err != nil {
-			log.Println("[Core] Failed to accept reverse stream:", err)
-			return
-		}
-
-		// Serve RPC for Server -> Client calls
-		// We need to register the RPC handler
-		// Circular dependency: RPC handler needs access to Core?
-		// We will inject the handler logic later or use a global.
-		// For now, let's assume `rpc.DefaultServer` or new server.
-		srv := rpc.NewServer()
-		// We need to register "ClientRPC"
-		// How to do this cleanly?
-		// We can expose a Register function in `rpc` package.
-		// For now, we will handle this in `main` or `Start`.
-		// But `ConnectServer` is called from `Start`.
-
-		// Let's defer the actual `ServeConn` to a callback or do it here if we can import `client/pkg/rpc`.
-		// We can't import `client/pkg/rpc` if `client/pkg/rpc` imports `core` (cycle).
-		// Solution: Define the interface here or put RPC handler in a separate package that imports core,
-		// and core does NOT import RPC handler.
-		// But `ConnectServer` is in `core`.
-
-		// Let's use a callback hook.
-		if OnReverseRPC != nil {
-			OnReverseRPC(srv, revStream)
+	State.ServerVersion = reply.ServerVersion
+	State.Capabilities = reply.Capabilities
+	State.UpgradeNotice = ""
+	State.AvailableUpdate = reply.Update
+	if reply.UpgradeRecommended {
+		State.UpgradeNotice = fmt.Sprintf("Server is %s but this client is %s, please upgrade", reply.ServerVersion, common.Version)
+		if reply.Update != nil {
+			State.UpgradeNotice = fmt.Sprintf("Version %s is available (this client is %s)", reply.Update.Version, common.Version)
 		}
-	}()
+		log.Printf("[Core] Server %s recommends upgrading this client (%s)", reply.ServerVersion, common.Version)
+	}
 
 	State.IsConnected = true
+	State.DisconnectReason = ""
+	State.ReconnectPaused = false
+	State.LastSeen = time.Now()
+	State.MissedBeats = 0
+
+	// 6. Keep the link alive and detect dead sessions
+	go heartbeatLoop(session, peer)
 
-	// 6. Start Data Loop (Accept streams from Server for data forwarding)
+	// 7. Start Data Loop (Accept streams from Server for data forwarding)
 	go acceptDataStreams(session)
 
-	return nil
+	return true, nil
 }
 
-var OnReverseRPC func(*rpc.Server, net.Conn)
+// OnPeer registers the handlers for Server -> Client calls on a new control peer.
+// Set by main (client/pkg/rpc), core cannot import it without a cycle.
+var OnPeer func(*jsonrpc.Peer)
+
+// handshakeTimeout bounds the handshake call on a fresh session
+const handshakeTimeout = 15 * time.Second
 
 func acceptDataStreams(session *yamux.Session) {
 	for {
@@ -150,59 +208,89 @@ func acceptDataStreams(session *yamux.Session) {
 			State.Lock.Unlock()
 			return
 		}
-		// Check if it's a data stream (not the control one, which we already handled?)
-		// Actually, Yamux doesn't distinguish "types" in Accept().
-		// We already Accepted the FIRST stream as Reverse Control.
-		// So subsequent streams MUST be Data Streams (Server requesting connection).
+		// The control stream is the one we opened, so every accepted stream is a data stream
 
 		go handleDataStream(stream)
 	}
 }
 
 func handleDataStream(stream net.Conn) {
-	// 1. Read Handshake (Target IP:Port)
-	// Protocol: "IP:Port\n"
-	reader := bufio.NewReader(stream)
-	targetAddr, err := reader.ReadString('\n')
-	if err != nil {
+	// 1. Read Handshake Frame
+	var hs common.StreamHandshake
+	if err := common.ReadFrame(stream, &hs); err != nil {
 		log.Println("[Core] Failed to read handshake:", err)
+		replyStatus(stream, common.StatusBadRequest, err.Error())
+		stream.Close()
+		return
+	}
+	log.Printf("[Core] New data stream request for: %s (service %s, %s)", hs.Target, hs.ServiceID, hs.Protocol)
+
+	if hs.Protocol != common.ProtocolTCP && hs.Protocol != common.ProtocolUDP {
+		replyStatus(stream, common.StatusUnsupported, "unsupported protocol: "+hs.Protocol)
+		stream.Close()
+		return
+	}
+	if hs.ProxyProtocol > 2 || (hs.ProxyProtocol != 0 && hs.Protocol != common.ProtocolTCP) {
+		replyStatus(stream, common.StatusUnsupported, fmt.Sprintf("unsupported PROXY protocol v%d over %s", hs.ProxyProtocol, hs.Protocol))
+		stream.Close()
+		return
+	}
+	if hs.Flags&^common.FlagDynamic != 0 {
+		replyStatus(stream, common.StatusUnsupported, fmt.Sprintf("unsupported flags: %#x", hs.Flags))
 		stream.Close()
 		return
 	}
-	targetAddr = strings.TrimSpace(targetAddr)
-	log.Printf("[Core] New data stream request for: %s", targetAddr)
 
-	// 2. Connect to Local Target
-	localConn, err := net.Dial("tcp", targetAddr)
+	// 2. Only dial configured services or allowlisted addresses.
+	// Dynamic (proxy) streams go through the same check, so without an allowlist they can only reach configured services.
+	dialAddr, err := checkTarget(hs.Target, hs.Protocol)
 	if err != nil {
-		log.Printf("[Core] Failed to dial local target %s: %v", targetAddr, err)
+		recordRejected(hs.Target, err)
+		replyStatus(stream, common.StatusRefused, err.Error())
 		stream.Close()
 		return
 	}
 
-	// 3. Pipe
-	go func() {
-		defer localConn.Close()
-		defer stream.Close()
-		// We MUST NOT use 'stream' directly if 'reader' has buffered data!
-		// 'reader' is a bufio.Reader wrapping 'stream'. It may have read more bytes than just the newline.
-		// We need to write any buffered bytes to localConn first, then copy the rest from stream.
+	// 3. Connect to Local Target
+	localConn, err := net.DialTimeout(hs.Protocol, dialAddr, dialTimeout)
+	if err != nil {
+		log.Printf("[Core] Failed to dial local target %s: %v", dialAddr, err)
+		code := uint8(common.StatusDialFailed)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			code = common.StatusTimeout
+		}
+		replyStatus(stream, code, err.Error())
+		stream.Close()
+		return
+	}
 
-		if reader.Buffered() > 0 {
-			bufferedBytes, _ := reader.Peek(reader.Buffered())
-			localConn.Write(bufferedBytes)
+	// 4. Let the target know who is really connecting
+	if hs.ProxyProtocol != 0 {
+		if err := writeProxyHeader(localConn, hs.ProxyProtocol, hs.SourceAddr, hs.DestAddr); err != nil {
+			log.Printf("[Core] Failed to write PROXY header to %s: %v", dialAddr, err)
+			replyStatus(stream, common.StatusDialFailed, "write PROXY header: "+err.Error())
+			localConn.Close()
+			stream.Close()
+			return
 		}
+	}
+
+	// 5. Tell the server it can start piping
+	if err := replyStatus(stream, common.StatusOK, ""); err != nil {
+		localConn.Close()
+		stream.Close()
+		return
+	}
 
-		// Now copy the rest directly from stream (assuming bufio doesn't hold anything else invisible)
-		// actually, mixing bufio and direct read is dangerous if we don't discard the buffered part from the reader?
-		// No, Peek just looks. We need to consume it or just Write it.
-		// But wait, if we use io.Copy(localConn, stream), it reads from 'stream'.
-		// 'stream' cursor is ahead of 'reader' cursor if reader buffered data.
-		// So we are good?
-		// NO! 'stream' cursor is AHEAD. 'reader' has data in memory that 'stream' already delivered.
-		// So we must write reader.Buffered() to localConn.
-		// AND we must ensure subsequent reads come from 'stream'.
+	if hs.Protocol == common.ProtocolUDP {
+		go relayUDP(stream, localConn)
+		return
+	}
 
+	// 6. Pipe
+	go func() {
+		defer localConn.Close()
+		defer stream.Close()
 		io.Copy(localConn, stream)
 	}()
 	go func() {
@@ -211,3 +299,7 @@ func handleDataStream(stream net.Conn) {
 		io.Copy(stream, localConn)
 	}()
 }
+
+func replyStatus(stream net.Conn, code uint8, message string) error {
+	return common.WriteFrame(stream, &common.StreamStatus{Code: code, Message: message})
+}
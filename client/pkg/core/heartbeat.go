@@ -0,0 +1,79 @@
+package core
+
+import (
+	"client/config"
+	"common"
+	"common/jsonrpc"
+	"context"
+	"log"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// heartbeatLoop pings the server until the session closes.
+// After MaxMissed beats without a reply the session is torn down,
+// so the reconnect loop can establish a fresh one.
+func heartbeatLoop(session *yamux.Session, peer *jsonrpc.Peer) {
+	cfg := config.Get().Heartbeat
+	interval := time.Duration(cfg.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	maxMissed := cfg.MaxMissed
+	if maxMissed <= 0 {
+		maxMissed = 3
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-session.CloseChan():
+			return
+		case <-ticker.C:
+		}
+
+		State.Lock.RLock()
+		args := &common.HeartbeatArgs{
+			ClientID:    State.ClientID,
+			LastRTTMs:   State.LastRTT.Milliseconds(),
+			MissedBeats: State.MissedBeats,
+		}
+		State.Lock.RUnlock()
+
+		start := time.Now()
+		var reply common.BaseReply
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := peer.Call(ctx, common.MethodHeartbeat, args, &reply)
+		cancel()
+		if err == context.DeadlineExceeded {
+			log.Println("[Core] Heartbeat timed out")
+		}
+
+		State.Lock.Lock()
+		if err == nil {
+			State.LastRTT = time.Since(start)
+			State.LastSeen = time.Now()
+			State.MissedBeats = 0
+		} else {
+			State.MissedBeats++
+		}
+		missed := State.MissedBeats
+		State.Lock.Unlock()
+
+		if OnUpdate != nil {
+			OnUpdate()
+		}
+
+		if missed >= maxMissed {
+			log.Printf("[Core] %d heartbeats missed, closing session", missed)
+			State.Lock.Lock()
+			State.IsConnected = false
+			State.Lock.Unlock()
+			session.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// writeProxyHeader writes a HAProxy PROXY protocol header so the target sees
+// the visitor's address instead of ours. src/dst are "ip:port" strings from the
+// stream handshake; if they are missing the header says UNKNOWN (v1) or LOCAL (v2).
+func writeProxyHeader(w io.Writer, version uint8, src, dst string) error {
+	srcIP, srcPort := splitAddr(src)
+	dstIP, dstPort := splitAddr(dst)
+	known := srcIP != nil && dstIP != nil
+
+	var header []byte
+	switch version {
+	case 1:
+		switch {
+		case !known:
+			header = []byte("PROXY UNKNOWN\r\n")
+		case srcIP.To4() != nil && dstIP.To4() != nil:
+			header = []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP.To4(), dstIP.To4(), srcPort, dstPort))
+		default:
+			// A mixed pair is sent as IPv6, both sides in IPv6 text
+			header = []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6Text(srcIP), ipv6Text(dstIP), srcPort, dstPort))
+		}
+	case 2:
+		var buf bytes.Buffer
+		buf.Write(proxyV2Signature)
+		var addrs []byte
+		switch {
+		case !known:
+			buf.Write([]byte{0x20, 0x00}) // LOCAL, UNSPEC
+		case srcIP.To4() != nil && dstIP.To4() != nil:
+			buf.Write([]byte{0x21, 0x11}) // PROXY, TCP over IPv4
+			addrs = append(append(addrs, srcIP.To4()...), dstIP.To4()...)
+		default:
+			buf.Write([]byte{0x21, 0x21}) // PROXY, TCP over IPv6
+			addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+		}
+		if addrs != nil {
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcPort))
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstPort))
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+		buf.Write(addrs)
+		header = buf.Bytes()
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+// ipv6Text formats ip as IPv6 text, IPv4 as mapped "::ffff:a.b.c.d"
+func ipv6Text(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// splitAddr parses "ip:port", returning a nil IP if it is not one
+func splitAddr(addr string) (net.IP, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, 0
+	}
+	return net.ParseIP(host), port
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestWriteProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst string
+		want     string
+	}{
+		{"ipv4", "1.2.3.4:5000", "10.0.0.1:80", "PROXY TCP4 1.2.3.4 10.0.0.1 5000 80\r\n"},
+		{"ipv6", "[2001:db8::1]:5000", "[::1]:80", "PROXY TCP6 2001:db8::1 ::1 5000 80\r\n"},
+		{"mixed", "1.2.3.4:5000", "[::1]:80", "PROXY TCP6 ::ffff:1.2.3.4 ::1 5000 80\r\n"},
+		{"mapped ipv4", "[::ffff:1.2.3.4]:5000", "10.0.0.1:80", "PROXY TCP4 1.2.3.4 10.0.0.1 5000 80\r\n"},
+		{"unknown", "", "", "PROXY UNKNOWN\r\n"},
+		{"hostname", "example.com:5000", "10.0.0.1:80", "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, 1, tt.src, tt.dst); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeaderV2(t *testing.T) {
+	const sig = "0d0a0d0a000d0a515549540a"
+	tests := []struct {
+		name     string
+		src, dst string
+		want     string // hex
+	}{
+		{"ipv4", "1.2.3.4:5000", "10.0.0.1:80",
+			sig + "2111" + "000c" + "01020304" + "0a000001" + "1388" + "0050"},
+		{"ipv6", "[2001:db8::1]:5000", "[::1]:80",
+			sig + "2121" + "0024" + "20010db8000000000000000000000001" + "00000000000000000000000000000001" + "1388" + "0050"},
+		{"mixed", "1.2.3.4:5000", "[::1]:80",
+			sig + "2121" + "0024" + "00000000000000000000ffff01020304" + "00000000000000000000000000000001" + "1388" + "0050"},
+		{"unknown", "", "", sig + "2000" + "0000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, 2, tt.src, tt.dst); err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(buf.Bytes()); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeaderBadVersion(t *testing.T) {
+	if err := writeProxyHeader(&bytes.Buffer{}, 3, "1.2.3.4:1", "1.2.3.4:2"); err == nil {
+		t.Error("version 3 accepted")
+	}
+}
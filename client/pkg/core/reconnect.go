@@ -0,0 +1,88 @@
+package core
+
+import (
+	"client/config"
+	"log"
+	"time"
+)
+
+// ReconnectInterval is the delay between connection attempts
+const ReconnectInterval = 5 * time.Second
+
+// OnConnectResult is called after every reconnect attempt (nil error on success)
+var OnConnectResult func(err error)
+
+// RunConnectionLoop reconnects to the configured server whenever the session
+// is down, until stop is closed. The address is re-read on every attempt so
+// a config reload takes effect on the next reconnect.
+func RunConnectionLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(ReconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		State.Lock.RLock()
+		idle := State.IsConnected || State.ReconnectPaused
+		State.Lock.RUnlock()
+		if idle {
+			continue
+		}
+
+		addr := config.Get().ServerAddr
+		log.Println("[Core] Connecting to", addr)
+		err := ConnectServer(addr)
+		if err != nil {
+			log.Printf("[Core] Connect failed: %v", err)
+		} else {
+			log.Println("[Core] Connected!")
+		}
+
+		if OnConnectResult != nil {
+			OnConnectResult(err)
+		}
+	}
+}
+
+// Disconnect closes the current session, if any.
+// The connection loop (if running) will reconnect on its next tick.
+func Disconnect() {
+	State.Lock.Lock()
+	session := State.Session
+	State.IsConnected = false
+	State.Lock.Unlock()
+
+	if session != nil {
+		session.Close()
+	}
+	if OnUpdate != nil {
+		OnUpdate()
+	}
+}
+
+// Kicked records that an operator closed our session and pauses the
+// connection loop, so we do not reconnect right after being thrown out
+func Kicked(reason string) {
+	log.Printf("[Core] Disconnected by server: %s", reason)
+	State.Lock.Lock()
+	State.DisconnectReason = reason
+	State.ReconnectPaused = true
+	State.Lock.Unlock()
+	if OnUpdate != nil {
+		OnUpdate()
+	}
+}
+
+// Resume lets the connection loop reconnect after Kicked
+func Resume() {
+	State.Lock.Lock()
+	State.ReconnectPaused = false
+	State.Lock.Unlock()
+	if OnUpdate != nil {
+		OnUpdate()
+	}
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"common"
+	"context"
+	"errors"
+	"time"
+)
+
+// syncTimeout bounds a SyncConfig call
+const syncTimeout = 15 * time.Second
+
+// SyncServices sends our full service list to the server (SyncConfig).
+// The server answers by pushing the merged list, including assigned
+// public ports, back as a PushConfig notification.
+func SyncServices() error {
+	State.Lock.RLock()
+	peer := State.Peer
+	connected := State.IsConnected
+	args := &common.SyncConfigArgs{
+		ClientID: State.ClientID,
+		// Copy services
+		Services: append([]common.TargetService{}, State.Services...),
+		Restore:  !State.HasServiceList,
+		// Lets the server show which of its services wait for our user
+		Unapproved: UnapprovedServices(),
+	}
+	State.Lock.RUnlock()
+
+	if !connected || peer == nil {
+		return errors.New("not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	var reply common.BaseReply
+	if err := peer.Call(ctx, common.MethodSyncConfig, args, &reply); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return errors.New(reply.Message)
+	}
+	return nil
+}
+
+// SetServices replaces the local service list (from a user edit or a server push)
+func SetServices(services []common.TargetService) {
+	State.Lock.Lock()
+	State.Services = services
+	State.HasServiceList = true
+	State.Lock.Unlock()
+
+	if OnUpdate != nil {
+		OnUpdate()
+	}
+}
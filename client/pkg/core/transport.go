@@ -0,0 +1,135 @@
+package core
+
+import (
+	"client/config"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// dialServer opens the raw connection that carries the yamux session.
+// TLS is used unless explicitly disabled in config.
+func dialServer(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	conf := config.Get()
+	if conf.TLS.Insecure {
+		log.Println("[Core] WARNING: TLS disabled, connecting in plaintext")
+		return dialer.Dial("tcp", addr)
+	}
+
+	tlsConfig, err := buildTLSConfig(addr, conf)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
+
+func buildTLSConfig(addr string, conf *config.Config) (*tls.Config, error) {
+	cfg := conf.TLS
+
+	serverName := cfg.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// 1. Fingerprint pin: trust exactly one certificate, ignore CA chain and hostname
+	if cfg.Fingerprint != "" {
+		want, err := parseFingerprint(cfg.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != want {
+				return fmt.Errorf("server certificate fingerprint mismatch: got %s", hex.EncodeToString(sum[:]))
+			}
+			return nil
+		}
+		return tlsConfig, nil
+	}
+
+	// 2. Custom CA file
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+		return tlsConfig, nil
+	}
+
+	// 3. Otherwise system roots, and a certificate they don't vouch for (the
+	// server's self-signed default) is trusted on first use and pinned
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return trustOnFirstUse(rawCerts, serverName)
+	}
+	return tlsConfig, nil
+}
+
+// trustOnFirstUse accepts a certificate the system roots verify for
+// serverName. Any other one is pinned as tls.fingerprint, so from the next
+// connection on only that exact certificate is accepted.
+func trustOnFirstUse(rawCerts [][]byte, serverName string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("parse server certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates}); err == nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(rawCerts[0])
+	fp := hex.EncodeToString(sum[:])
+	log.Printf("[Core] WARNING: pinning server certificate %s on first use, compare it with the fingerprint in the server log", fp)
+	config.SaveFingerprint(fp)
+	return nil
+}
+
+// parseFingerprint accepts "AB:CD:..." or "abcd..." forms
+func parseFingerprint(s string) (string, error) {
+	fp := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+	if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 fingerprint: %s", s)
+	}
+	return fp, nil
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"common"
+	"errors"
+	"net"
+	"time"
+)
+
+// udpIdleTimeout closes a UDP relay after this long without datagrams in either direction.
+// The server reaps its side on its own timeout, this only guards against leaks.
+const udpIdleTimeout = 2 * time.Minute
+
+// relayUDP carries length-framed datagrams between the stream and a connected UDP socket
+func relayUDP(stream net.Conn, localConn net.Conn) {
+	defer stream.Close()
+	defer localConn.Close()
+
+	// Stream -> Target
+	go func() {
+		defer localConn.Close()
+		buf := make([]byte, common.MaxDatagram)
+		for {
+			payload, err := common.ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			localConn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+			if _, err := localConn.Write(payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Target -> Stream
+	buf := make([]byte, common.MaxDatagram)
+	for {
+		localConn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := localConn.Read(buf)
+		if err != nil {
+			// ICMP port unreachable surfaces as a read error on connected sockets;
+			// only give up on timeout or close
+			if ne, ok := err.(net.Error); ok && !ne.Timeout() && !errors.Is(err, net.ErrClosed) {
+				continue
+			}
+			return
+		}
+		if err := common.WriteDatagram(stream, buf[:n]); err != nil {
+			return
+		}
+	}
+}
@@ -1,22 +1,38 @@
 package rpc
 
 import (
+	"client/pkg/core"
 	"common"
+	"common/jsonrpc"
+	"context"
 	"log"
 )
 
+// ClientRPC handles Server -> Client calls.
+// Shared by the Wails app and the headless client.
 type ClientRPC struct{}
 
-func (r *ClientRPC) PushConfig(args *common.PushConfigArgs, reply *common.BaseReply) error {
+// Register serves ClientRPC on a control peer, used as core.OnPeer
+func Register(peer *jsonrpc.Peer) {
+	r := new(ClientRPC)
+	jsonrpc.Handle(peer, common.MethodPushConfig, r.PushConfig)
+	jsonrpc.Handle(peer, common.MethodDisconnect, r.Disconnect)
+}
+
+// PushConfig updates local services from server.
+// Arrives as a call (web edits, the server waits for the ack) or as a notification.
+// Services the server added on its own are not dialed until the user approves them;
+// the reply tells the server which ones wait.
+func (r *ClientRPC) PushConfig(ctx context.Context, args *common.PushConfigArgs) (*common.PushConfigReply, error) {
 	log.Printf("[RPC] Received PushConfig: %d services", len(args.Services))
-	// Update local state (logic in Core?)
-	// We can't import Core if Core imports us.
-	// But Core imports common.
-	// We can use a callback or event bus.
-	// For simplicity, let's just log for now, or use a global in a third package.
-	// Or, pass a handler to `ClientRPC` struct.
-	
-	// TODO: Update UI/State
-	reply.Success = true
-	return nil
+	pending := core.ApplyPushedServices(args.Services)
+
+	return &common.PushConfigReply{Success: true, Unapproved: pending}, nil
+}
+
+// Disconnect is sent by the server before it closes our session on an operator's request.
+// Arrives as a notification, handled before the session close is seen.
+func (r *ClientRPC) Disconnect(ctx context.Context, args *common.DisconnectArgs) (*common.BaseReply, error) {
+	core.Kicked(args.Reason)
+	return &common.BaseReply{Success: true}, nil
 }
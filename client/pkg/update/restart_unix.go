@@ -0,0 +1,18 @@
+//go:build !windows
+
+package update
+
+import (
+	"os"
+	"syscall"
+)
+
+// Restart replaces the process with the executable on disk, keeping PID and
+// arguments (so systemd keeps tracking it)
+func Restart() error {
+	exe, err := Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
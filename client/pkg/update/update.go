@@ -0,0 +1,280 @@
+// Package update installs signed client builds offered by the server.
+//
+// Apply downloads the build over the control stream, verifies its ed25519
+// signature against TrustedKey, swaps it in for the running executable
+// (keeping "<exe>.old") and leaves a "<exe>.pending" marker. The new build
+// calls CheckPending on start and Confirm once connected; if it does not get
+// there in time, or keeps crashing, the old executable is restored.
+package update
+
+import (
+	"client/config"
+	"common"
+	"common/jsonrpc"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrustedKey is the base64 ed25519 public key builds must be signed with.
+// Set at build time with -ldflags "-X client/pkg/update.TrustedKey=<key>",
+// otherwise update.public_key from config.yaml is used.
+var TrustedKey = ""
+
+const (
+	chunkTimeout     = 30 * time.Second
+	confirmTimeout   = 2 * time.Minute // New build must connect within this long
+	maxStartAttempts = 3               // Roll back after this many starts without connecting
+)
+
+// pending is the marker left next to the executable while an update is unconfirmed
+type pending struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Attempts int    `json:"attempts"`
+}
+
+var (
+	confirmTimer *time.Timer
+	timerLock    sync.Mutex
+)
+
+// Executable returns the path of the running binary, symlinks resolved
+func Executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+func trustedKey() (ed25519.PublicKey, error) {
+	encoded := TrustedKey
+	if encoded == "" {
+		encoded = config.Get().Update.PublicKey
+	}
+	if encoded == "" {
+		return nil, errors.New("no update public key configured, refusing unsigned updates")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("update public key is not a base64 ed25519 key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Apply downloads, verifies and installs info. The caller restarts afterwards (Restart).
+func Apply(ctx context.Context, peer *jsonrpc.Peer, info *common.UpdateInfo) error {
+	key, err := trustedKey()
+	if err != nil {
+		return err
+	}
+	if info.OS != runtime.GOOS || info.Arch != runtime.GOARCH {
+		return fmt.Errorf("update is for %s/%s, we are %s/%s", info.OS, info.Arch, runtime.GOOS, runtime.GOARCH)
+	}
+	if common.CompareVersions(info.Version, common.Version) <= 0 {
+		return fmt.Errorf("update %s is not newer than %s", info.Version, common.Version)
+	}
+	digest, err := hex.DecodeString(info.SHA256)
+	if err != nil {
+		return fmt.Errorf("bad digest: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(info.Signature)
+	if err != nil {
+		return fmt.Errorf("bad signature: %v", err)
+	}
+	// Check the signature before downloading anything
+	if !ed25519.Verify(key, common.UpdateSigningMessage(info.Version, info.OS, info.Arch, digest), sig) {
+		return errors.New("update signature is invalid")
+	}
+
+	exe, err := Executable()
+	if err != nil {
+		return err
+	}
+	tmp := exe + ".new"
+	if err := download(ctx, peer, info, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Swap: exe -> exe.old, exe.new -> exe. Renaming a running binary works on Windows too.
+	os.Remove(exe + ".old")
+	if err := os.Rename(exe, exe+".old"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Rename(exe+".old", exe)
+		return err
+	}
+
+	if err := writePending(exe, &pending{From: common.Version, To: info.Version}); err != nil {
+		log.Printf("[Update] Failed to write pending marker, no automatic rollback: %v", err)
+	}
+	log.Printf("[Update] Installed %s, previous build kept as %s", info.Version, exe+".old")
+	return nil
+}
+
+// download fetches the build in chunks and checks size and digest
+func download(ctx context.Context, peer *jsonrpc.Peer, info *common.UpdateInfo, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	var offset int64
+	for {
+		args := &common.UpdateChunkArgs{
+			Version: info.Version,
+			OS:      info.OS,
+			Arch:    info.Arch,
+			Offset:  offset,
+			Length:  common.MaxUpdateChunk,
+		}
+		var reply common.UpdateChunkReply
+		callCtx, cancel := context.WithTimeout(ctx, chunkTimeout)
+		err := peer.Call(callCtx, common.MethodUpdateChunk, args, &reply)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("download at %d: %v", offset, err)
+		}
+
+		if _, err := f.Write(reply.Data); err != nil {
+			return err
+		}
+		h.Write(reply.Data)
+		offset += int64(len(reply.Data))
+		if offset > info.Size {
+			return errors.New("download larger than announced")
+		}
+		if reply.EOF || len(reply.Data) == 0 {
+			break
+		}
+	}
+
+	if offset != info.Size {
+		return fmt.Errorf("download size %d, expected %d", offset, info.Size)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != info.SHA256 {
+		return errors.New("download digest mismatch")
+	}
+	return f.Close()
+}
+
+// Pending reports whether we are an installed update that has not connected yet
+func Pending() bool {
+	exe, err := Executable()
+	if err != nil {
+		return false
+	}
+	_, err = readPending(exe)
+	return err == nil
+}
+
+// CheckPending runs when we first try to connect (at startup for the headless
+// client). If we are an unconfirmed update, count the start and arm the
+// rollback timer; roll back right away after too many starts.
+func CheckPending() {
+	exe, err := Executable()
+	if err != nil {
+		return
+	}
+	p, err := readPending(exe)
+	if err != nil {
+		return
+	}
+
+	p.Attempts++
+	if p.Attempts > maxStartAttempts {
+		log.Printf("[Update] Update %s started %d times without connecting, rolling back to %s", p.To, p.Attempts-1, p.From)
+		rollback(exe)
+		return
+	}
+	writePending(exe, p)
+
+	log.Printf("[Update] Running unconfirmed update %s (start %d), rolling back to %s unless connected within %v", p.To, p.Attempts, p.From, confirmTimeout)
+	timerLock.Lock()
+	confirmTimer = time.AfterFunc(confirmTimeout, func() {
+		log.Printf("[Update] Update %s did not connect in time, rolling back to %s", p.To, p.From)
+		rollback(exe)
+	})
+	timerLock.Unlock()
+}
+
+// Confirm marks a pending update as good. Call after a successful connect.
+func Confirm() {
+	timerLock.Lock()
+	if confirmTimer != nil {
+		confirmTimer.Stop()
+		confirmTimer = nil
+	}
+	timerLock.Unlock()
+
+	exe, err := Executable()
+	if err != nil {
+		return
+	}
+	if p, err := readPending(exe); err == nil {
+		os.Remove(exe + ".pending")
+		log.Printf("[Update] Update %s confirmed", p.To)
+	}
+}
+
+// rollback restores exe.old and restarts into it
+func rollback(exe string) {
+	if _, err := os.Stat(exe + ".old"); err != nil {
+		log.Printf("[Update] Cannot roll back, %s.old is missing", exe)
+		os.Remove(exe + ".pending")
+		return
+	}
+	os.Remove(exe + ".failed")
+	if err := os.Rename(exe, exe+".failed"); err != nil {
+		log.Printf("[Update] Rollback failed: %v", err)
+		return
+	}
+	if err := os.Rename(exe+".old", exe); err != nil {
+		log.Printf("[Update] Rollback failed: %v", err)
+		os.Rename(exe+".failed", exe)
+		return
+	}
+	os.Remove(exe + ".pending")
+
+	if err := Restart(); err != nil {
+		log.Printf("[Update] Rolled back, but restart failed: %v", err)
+	}
+}
+
+func readPending(exe string) (*pending, error) {
+	data, err := os.ReadFile(exe + ".pending")
+	if err != nil {
+		return nil, err
+	}
+	var p pending
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func writePending(exe string, p *pending) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(exe+".pending", data, 0644)
+}
@@ -0,0 +1,300 @@
+// Package jsonrpc is the control channel protocol: JSON-RPC 2.0 messages,
+// one JSON object per line, in both directions over a single stream.
+//
+// Both ends are a Peer: they can call, notify and serve methods at the same
+// time. Two extension members ride along with the standard ones:
+//   - "schema": version of the params/result schema of the method, checked
+//     against the receiver's table so incompatible messages fail loudly
+//   - "timeout_ms": the caller's remaining deadline, applied to the handler's context
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Version is the JSON-RPC protocol version
+const Version = "2.0"
+
+// Error codes: JSON-RPC 2.0 predefined ones, then our server error range
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeApplication    = -32000 // Handler returned an error
+	CodeSchemaMismatch = -32001 // Params or result schema version differs
+	CodeTimeout        = -32002 // Handler did not finish before the caller's deadline
+)
+
+// ErrClosed is returned for calls on (or pending on) a closed peer
+var ErrClosed = errors.New("jsonrpc: connection closed")
+
+// Message is a request, notification or response
+type Message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *uint64         `json:"id,omitempty"` // Absent for notifications
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+
+	Schema    int   `json:"schema,omitempty"`
+	TimeoutMs int64 `json:"timeout_ms,omitempty"`
+}
+
+// Error is a JSON-RPC error object
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+// HandlerFunc serves one method. params is the raw JSON of the request.
+type HandlerFunc func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// Peer is one end of a control stream
+type Peer struct {
+	conn    io.ReadWriteCloser
+	schemas map[string]int
+
+	writeLock sync.Mutex
+	enc       *json.Encoder
+
+	lock     sync.Mutex
+	nextID   uint64
+	pending  map[uint64]chan *Message
+	handlers map[string]HandlerFunc
+
+	ctx    context.Context // Canceled when the peer closes
+	cancel context.CancelFunc
+}
+
+// NewPeer wraps a stream. schemas maps method names to their schema version;
+// methods missing from the table are version 0. Register handlers, then Run.
+func NewPeer(conn io.ReadWriteCloser, schemas map[string]int) *Peer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Peer{
+		conn:     conn,
+		schemas:  schemas,
+		enc:      json.NewEncoder(conn),
+		pending:  make(map[uint64]chan *Message),
+		handlers: make(map[string]HandlerFunc),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Handle registers fn for method, replacing any previous handler
+func (p *Peer) Handle(method string, fn HandlerFunc) {
+	p.lock.Lock()
+	p.handlers[method] = fn
+	p.lock.Unlock()
+}
+
+// Handle registers a typed handler: params are decoded into P and the
+// returned R becomes the result
+func Handle[P any, R any](p *Peer, method string, fn func(ctx context.Context, params *P) (R, error)) {
+	p.Handle(method, func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+		params := new(P)
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, params); err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+			}
+		}
+		return fn(ctx, params)
+	})
+}
+
+// Done is closed when the peer has shut down
+func (p *Peer) Done() <-chan struct{} {
+	return p.ctx.Done()
+}
+
+// Close closes the stream and fails all pending calls
+func (p *Peer) Close() error {
+	p.cancel()
+	return p.conn.Close()
+}
+
+// Run reads messages until the stream fails or the peer is closed.
+// Requests are served concurrently. Notifications are handled in order on
+// the read loop, so their handlers must not wait on calls to the other side.
+func (p *Peer) Run() error {
+	defer p.Close()
+
+	dec := json.NewDecoder(p.conn)
+	for {
+		var msg Message
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.JSONRPC != Version {
+			log.Printf("[RPC] Dropping message with jsonrpc version %q", msg.JSONRPC)
+			continue
+		}
+
+		switch {
+		case msg.Method != "" && msg.ID == nil:
+			p.serve(&msg)
+		case msg.Method != "":
+			go p.serve(&msg)
+		case msg.ID != nil:
+			p.lock.Lock()
+			ch, ok := p.pending[*msg.ID]
+			delete(p.pending, *msg.ID)
+			p.lock.Unlock()
+			if ok {
+				ch <- &msg
+			}
+		}
+	}
+}
+
+// serve runs the handler of one request or notification
+func (p *Peer) serve(req *Message) {
+	result, err := p.dispatch(req)
+	if req.ID == nil {
+		if err != nil {
+			log.Printf("[RPC] Notification %s failed: %v", req.Method, err)
+		}
+		return
+	}
+
+	resp := &Message{JSONRPC: Version, ID: req.ID, Schema: p.schemas[req.Method]}
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{Code: CodeApplication, Message: err.Error()}
+		}
+		resp.Result = nil
+		resp.Error = rpcErr
+	}
+	if err := p.write(resp); err != nil {
+		log.Printf("[RPC] Failed to reply to %s: %v", req.Method, err)
+	}
+}
+
+func (p *Peer) dispatch(req *Message) (interface{}, error) {
+	p.lock.Lock()
+	fn, ok := p.handlers[req.Method]
+	p.lock.Unlock()
+	if !ok {
+		return nil, &Error{Code: CodeMethodNotFound, Message: "method not found: " + req.Method}
+	}
+	if want := p.schemas[req.Method]; req.Schema != want {
+		return nil, &Error{Code: CodeSchemaMismatch, Message: fmt.Sprintf("%s: schema v%d, expected v%d", req.Method, req.Schema, want)}
+	}
+
+	ctx := p.ctx
+	if req.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.TimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	result, err := fn(ctx, req.Params)
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, &Error{Code: CodeTimeout, Message: req.Method + ": deadline exceeded"}
+	}
+	return result, err
+}
+
+// Call invokes method on the other side and decodes the result into result
+// (which may be nil). It returns when the reply arrives, ctx is done or the peer closes.
+func (p *Peer) Call(ctx context.Context, method string, params, result interface{}) error {
+	req, err := p.newMessage(method, params)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.TimeoutMs = time.Until(deadline).Milliseconds()
+		if req.TimeoutMs <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+
+	ch := make(chan *Message, 1)
+	p.lock.Lock()
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = ch
+	p.lock.Unlock()
+	req.ID = &id
+
+	forget := func() {
+		p.lock.Lock()
+		delete(p.pending, id)
+		p.lock.Unlock()
+	}
+
+	if err := p.write(req); err != nil {
+		forget()
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if want := p.schemas[method]; resp.Schema != want {
+			return &Error{Code: CodeSchemaMismatch, Message: fmt.Sprintf("%s result: schema v%d, expected v%d", method, resp.Schema, want)}
+		}
+		if result != nil && len(resp.Result) > 0 {
+			return json.Unmarshal(resp.Result, result)
+		}
+		return nil
+	case <-ctx.Done():
+		forget()
+		return ctx.Err()
+	case <-p.ctx.Done():
+		forget()
+		return ErrClosed
+	}
+}
+
+// Notify sends a notification: no reply, no delivery guarantee beyond the stream
+func (p *Peer) Notify(method string, params interface{}) error {
+	msg, err := p.newMessage(method, params)
+	if err != nil {
+		return err
+	}
+	return p.write(msg)
+}
+
+func (p *Peer) newMessage(method string, params interface{}) (*Message, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{JSONRPC: Version, Method: method, Params: raw, Schema: p.schemas[method]}, nil
+}
+
+func (p *Peer) write(msg *Message) error {
+	select {
+	case <-p.ctx.Done():
+		return ErrClosed
+	default:
+	}
+
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	return p.enc.Encode(msg)
+}
@@ -0,0 +1,159 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ---------------- Data Stream Handshake ----------------
+//
+// Every data stream starts with one frame from the server (StreamHandshake)
+// answered by one frame from the client (StreamStatus). Only after a
+// StatusOK reply does either side start piping payload bytes.
+//
+// Frame layout:
+//
+//	Version (1 byte) | Length (2 bytes, big endian) | JSON Body (Length bytes)
+
+// StreamFrameVersion is the current data stream frame version
+const StreamFrameVersion = 1
+
+// maxFrameBody bounds a single handshake frame
+const maxFrameBody = 0xFFFF
+
+// Stream protocols
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp" // Payload is a sequence of datagram frames
+)
+
+// Stream status codes sent back by the client
+const (
+	StatusOK          = 0 // Target dialed, start piping
+	StatusBadRequest  = 1 // Handshake could not be parsed
+	StatusRefused     = 2 // Target not allowed by the client
+	StatusDialFailed  = 3 // Dial error (connection refused, unreachable...)
+	StatusTimeout     = 4 // Dial timed out
+	StatusUnsupported = 5 // Protocol or flag not supported by this client
+)
+
+// Stream handshake flags
+const (
+	// FlagDynamic marks a stream without a configured service (SOCKS/HTTP proxy).
+	// Target is "host:port" and host may be a domain name.
+	FlagDynamic uint32 = 1 << 0
+)
+
+// StreamHandshake is the first frame on a data stream (Server -> Client)
+type StreamHandshake struct {
+	ServiceID string `json:"service_id"`
+	Target    string `json:"target"`   // "IP:Port", or "host:port" with FlagDynamic
+	Protocol  string `json:"protocol"` // ProtocolTCP or ProtocolUDP
+	Flags     uint32 `json:"flags"`
+
+	// PROXY protocol version (0 off, 1, 2) and the addresses it carries.
+	// SourceAddr is the visitor, DestAddr the public address it connected to;
+	// both empty when the stream serves no single visitor (pooled HTTP upstreams).
+	ProxyProtocol uint8  `json:"proxy_protocol,omitempty"`
+	SourceAddr    string `json:"source_addr,omitempty"`
+	DestAddr      string `json:"dest_addr,omitempty"`
+}
+
+// StreamStatus is the reply to StreamHandshake (Client -> Server)
+type StreamStatus struct {
+	Code    uint8  `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// StatusText returns a readable name for a status code
+func StatusText(code uint8) string {
+	switch code {
+	case StatusOK:
+		return "ok"
+	case StatusBadRequest:
+		return "bad request"
+	case StatusRefused:
+		return "refused"
+	case StatusDialFailed:
+		return "dial failed"
+	case StatusTimeout:
+		return "timeout"
+	case StatusUnsupported:
+		return "unsupported"
+	}
+	return fmt.Sprintf("status %d", code)
+}
+
+// WriteFrame writes v as a versioned, length-prefixed JSON frame
+func WriteFrame(w io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxFrameBody {
+		return errors.New("frame too large")
+	}
+
+	buf := make([]byte, 3+len(body))
+	buf[0] = StreamFrameVersion
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(body)))
+	copy(buf[3:], body)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame reads one frame into v. It never reads past the frame,
+// so the caller can keep using r for payload afterwards.
+func ReadFrame(r io.Reader, v interface{}) error {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	// Builds before 2.0.0 sent the service ID unframed, so the first byte is a letter
+	if header[0] != StreamFrameVersion {
+		return fmt.Errorf("unsupported data stream frame version %d (want %d), the peer runs an incompatible fffrp version, upgrade both sides", header[0], StreamFrameVersion)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[1:3]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// ---------------- UDP Datagram Framing ----------------
+//
+// On a ProtocolUDP stream each datagram is sent as
+//
+//	Length (2 bytes, big endian) | Payload (Length bytes)
+
+// MaxDatagram is the largest datagram that can be framed
+const MaxDatagram = 0xFFFF
+
+// WriteDatagram writes one length-prefixed datagram
+func WriteDatagram(w io.Writer, payload []byte) error {
+	if len(payload) > MaxDatagram {
+		return errors.New("datagram too large")
+	}
+	buf := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(payload)))
+	copy(buf[2:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram reads one length-prefixed datagram into buf (which must hold MaxDatagram bytes)
+func ReadDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -1,49 +1,165 @@
 package common
 
-// Version is the protocol version
-const Version = "1.0.0"
+// Version is the protocol version (semver, see version.go for compatibility rules)
+const Version = "2.2.0"
 
 // TargetService represents a service to be exposed
 type TargetService struct {
-	ID         string `json:"id"`
-	LocalIP    string `json:"local_ip"`
-	LocalPort  int    `json:"local_port"`
-	RemotePort int    `json:"remote_port"` // The public port on server
-	Remark     string `json:"remark"`
+	ID         string `json:"id" yaml:"id"`
+	LocalIP    string `json:"local_ip" yaml:"local_ip"`
+	LocalPort  int    `json:"local_port" yaml:"local_port"`
+	RemotePort int    `json:"remote_port" yaml:"remote_port"` // The public port on server
+	Remark     string `json:"remark" yaml:"remark"`
+	Protocol   string `json:"protocol" yaml:"protocol,omitempty"` // ProtocolTCP (default) or ProtocolUDP
+
+	// HTTP virtual host routing: <Subdomain>.<client>.<domain> (Subdomain defaults to the ID)
+	Subdomain   string `json:"subdomain,omitempty" yaml:"subdomain,omitempty"`
+	HostRewrite string `json:"host_rewrite,omitempty" yaml:"host_rewrite,omitempty"` // Host header sent to the target, default unchanged
+
+	// HAProxy PROXY protocol header the client writes to the target before piping:
+	// 0 off, 1 text (v1), 2 binary (v2). TCP only.
+	ProxyProtocol int `json:"proxy_protocol,omitempty" yaml:"proxy_protocol,omitempty"`
+}
+
+// Proto returns the service protocol, defaulting to TCP
+func (s TargetService) Proto() string {
+	if s.Protocol == "" {
+		return ProtocolTCP
+	}
+	return s.Protocol
+}
+
+// ---------------- RPC Methods ----------------
+
+// Control stream methods (JSON-RPC 2.0, see common/jsonrpc)
+const (
+	MethodHandshake   = "server.handshake"    // C->S HandshakeArgs -> HandshakeReply
+	MethodSyncConfig  = "server.sync_config"  // C->S SyncConfigArgs -> BaseReply
+	MethodHeartbeat   = "server.heartbeat"    // C->S HeartbeatArgs -> BaseReply
+	MethodUpdateChunk = "server.update_chunk" // C->S UpdateChunkArgs -> UpdateChunkReply
+	MethodPushConfig  = "client.push_config"  // S->C PushConfigArgs -> PushConfigReply, also sent as a notification
+	MethodDisconnect  = "client.disconnect"   // S->C DisconnectArgs notification, the session closes right after
+)
+
+// Schemas is the schema version of every method's params and result.
+// Bump a method's entry whenever one of its messages below changes
+// incompatibly; peers then reject each other's calls instead of silently
+// dropping or zeroing fields. New optional fields that old peers may
+// ignore do not need a bump.
+var Schemas = map[string]int{
+	MethodHandshake:   1,
+	MethodSyncConfig:  1,
+	MethodHeartbeat:   1,
+	MethodUpdateChunk: 1,
+	MethodPushConfig:  1,
+	MethodDisconnect:  1,
 }
 
 // ---------------- RPC Args & Reply ----------------
 
 // BaseArgs for simple requests
 type BaseArgs struct {
-	ClientID string
+	ClientID string `json:"client_id"`
 }
 
 // BaseReply for simple responses
 type BaseReply struct {
-	Success bool
-	Message string
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
 }
 
-// HandshakeArgs for initial connection
+// HandshakeArgs for initial connection (MethodHandshake)
 type HandshakeArgs struct {
-	ClientID    string
-	Version     string
-	Name        string
-	Phone       string
-	ProjectName string
-	Remark      string
+	ClientID    string `json:"client_id"`
+	Version     string `json:"version"`
+	Name        string `json:"name"`
+	Phone       string `json:"phone"`
+	ProjectName string `json:"project_name"`
+	Remark      string `json:"remark"`
+	Token       string `json:"token"` // Shared secret or per-project token
+	// ClientSecret proves ClientID: generated with it and never shown, the
+	// server binds the identity to it on first use. Empty from older clients.
+	ClientSecret string `json:"client_secret,omitempty"`
+	// Capabilities this client supports; nil from 2.0.x clients (see BaselineCapabilities)
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Platform of the client binary (runtime.GOOS/GOARCH), to pick an update build
+	OS   string `json:"os,omitempty"`
+	Arch string `json:"arch,omitempty"`
+}
+
+// HandshakeReply answers MethodHandshake. A superset of BaseReply.
+type HandshakeReply struct {
+	Success       bool   `json:"success"`
+	Message       string `json:"message,omitempty"`
+	ServerVersion string `json:"server_version,omitempty"`
+	// Capabilities enabled for this session: the intersection of both sides
+	Capabilities []string `json:"capabilities,omitempty"`
+	// UpgradeRecommended is set when the client is compatible but older than the server
+	UpgradeRecommended bool `json:"upgrade_recommended,omitempty"`
+	// Update is a newer signed build for the client's platform, if the server has one
+	Update *UpdateInfo `json:"update,omitempty"`
 }
 
-// SyncConfigArgs for syncing target services
+// UpdateInfo describes a signed client build hosted by the server
+type UpdateInfo struct {
+	Version   string `json:"version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`    // Hex digest of the binary
+	Signature string `json:"signature"` // Base64 ed25519 signature of UpdateSigningMessage
+}
+
+// UpdateChunkArgs requests part of an update build (MethodUpdateChunk)
+type UpdateChunkArgs struct {
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Offset  int64  `json:"offset"`
+	Length  int    `json:"length"` // Capped at MaxUpdateChunk
+}
+
+// UpdateChunkReply carries the bytes at Offset
+type UpdateChunkReply struct {
+	Data []byte `json:"data"`
+	EOF  bool   `json:"eof"`
+}
+
+// HeartbeatArgs for periodic keepalive, carries the client's view of the link (MethodHeartbeat)
+type HeartbeatArgs struct {
+	ClientID    string `json:"client_id"`
+	LastRTTMs   int64  `json:"last_rtt_ms"`  // Round-trip time of the previous heartbeat
+	MissedBeats int    `json:"missed_beats"` // Consecutive heartbeats without reply before this one
+}
+
+// SyncConfigArgs for syncing target services (MethodSyncConfig)
 type SyncConfigArgs struct {
-	ClientID string
-	Services []TargetService
+	ClientID string          `json:"client_id"`
+	Services []TargetService `json:"services"`
+	// Restore is set when the client has no list of its own yet (fresh start):
+	// the server keeps stored services the client doesn't mention instead of deleting them
+	Restore bool `json:"restore"`
+	// Unapproved lists services the server set up that our user has not approved
+	// yet; the client refuses to dial them. Empty from older clients.
+	Unapproved []string `json:"unapproved,omitempty"`
 }
 
-// PushConfigArgs for Server -> Client sync
+// PushConfigArgs for Server -> Client sync (MethodPushConfig)
 type PushConfigArgs struct {
-	Services []TargetService
+	Services []TargetService `json:"services"`
+}
+
+// PushConfigReply answers MethodPushConfig calls. A superset of BaseReply.
+type PushConfigReply struct {
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	// Unapproved is SyncConfigArgs.Unapproved after applying the push
+	Unapproved []string `json:"unapproved,omitempty"`
+}
+
+// DisconnectArgs tells a client why an operator closed its session (MethodDisconnect)
+type DisconnectArgs struct {
+	Reason string `json:"reason"`
 }
 
 // ---------------- Constants ----------------
@@ -0,0 +1,22 @@
+package common
+
+import "fmt"
+
+// MaxUpdateChunk caps the bytes returned by one MethodUpdateChunk call
+const MaxUpdateChunk = 256 << 10
+
+// UpdateFileName is the name of a client build in the server's update directory
+func UpdateFileName(version, goos, goarch string) string {
+	name := fmt.Sprintf("fffrp-client_%s_%s_%s", version, goos, goarch)
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// UpdateSigningMessage is what a build's ed25519 signature covers: the digest
+// bound to version and platform, so a signed build cannot be replayed as
+// another version (downgrade) or for another platform
+func UpdateSigningMessage(version, goos, goarch string, digest []byte) []byte {
+	return []byte(fmt.Sprintf("fffrp-client-update\n%s\n%s\n%s\n%x", version, goos, goarch, digest))
+}
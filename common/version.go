@@ -0,0 +1,116 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MinCompatibleVersion is the oldest peer version we still talk to.
+// Peers must share our major version and be at least this version;
+// anything older inside that range only gets an upgrade recommendation.
+const MinCompatibleVersion = "2.0.0"
+
+// Capabilities are optional protocol features negotiated in the handshake.
+// Both sides enable only the intersection of what they advertise.
+const (
+	CapStreamHandshake = "stream_handshake" // Framed data stream handshake with status reply
+	CapUDP             = "udp"              // UDP services over datagram-framed streams
+	CapProxyProtocol   = "proxy_protocol"   // PROXY protocol v1/v2 header towards the target
+	CapDynamicStreams  = "dynamic_streams"  // FlagDynamic streams for SOCKS5/HTTP proxies
+	CapAutoUpdate      = "auto_update"      // Signed client builds offered in the handshake, MethodUpdateChunk
+)
+
+// LocalCapabilities is what this build supports
+var LocalCapabilities = []string{CapStreamHandshake, CapUDP, CapProxyProtocol, CapDynamicStreams, CapAutoUpdate}
+
+// BaselineCapabilities are implied for 2.0.x peers, which predate negotiation
+// and send no list but support all of these
+var BaselineCapabilities = []string{CapStreamHandshake, CapUDP, CapProxyProtocol, CapDynamicStreams}
+
+// ParseVersion parses "major.minor.patch" (a leading "v" and a
+// "-suffix" are ignored)
+func ParseVersion(v string) ([3]int, error) {
+	var parts [3]int
+	s := strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	fields := strings.Split(s, ".")
+	if len(fields) != 3 {
+		return parts, fmt.Errorf("invalid version %q", v)
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return parts, fmt.Errorf("invalid version %q", v)
+		}
+		parts[i] = n
+	}
+	return parts, nil
+}
+
+// CompareVersions returns -1, 0 or 1. Unparsable versions sort first.
+func CompareVersions(a, b string) int {
+	pa, errA := ParseVersion(a)
+	pb, errB := ParseVersion(b)
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// CheckCompatible returns an error if a peer at version v cannot talk to us
+func CheckCompatible(v string) error {
+	peer, err := ParseVersion(v)
+	if err != nil {
+		return err
+	}
+	local, _ := ParseVersion(Version)
+	if peer[0] != local[0] {
+		return fmt.Errorf("version %s is incompatible with %s (major version differs)", v, Version)
+	}
+	if CompareVersions(v, MinCompatibleVersion) < 0 {
+		return fmt.Errorf("version %s is older than the minimum supported %s", v, MinCompatibleVersion)
+	}
+	return nil
+}
+
+// IntersectCapabilities returns the capabilities in both lists, in the order of a
+func IntersectCapabilities(a, b []string) []string {
+	have := make(map[string]bool, len(b))
+	for _, c := range b {
+		have[c] = true
+	}
+	both := []string{}
+	for _, c := range a {
+		if have[c] {
+			both = append(both, c)
+			delete(have, c)
+		}
+	}
+	return both
+}
+
+// HasCapability reports whether caps contains c
+func HasCapability(caps []string, c string) bool {
+	for _, x := range caps {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
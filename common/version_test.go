@@ -0,0 +1,68 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2.0.0", "2.0.0", 0},
+		{"2.0.0", "2.0.1", -1},
+		{"2.10.0", "2.9.0", 1},
+		{"v2.1.0", "2.1.0", 0},
+		{"2.1.0-beta", "2.1.0", 0},
+		{"1.9.9", "2.0.0", -1},
+		{"bogus", "1.0.0", -1},
+		{"1.0.0", "bogus", 1},
+		{"bogus", "2.0", 0},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCompatible(t *testing.T) {
+	tests := []struct {
+		version string
+		ok      bool
+	}{
+		{Version, true},
+		{MinCompatibleVersion, true},
+		{"2.99.0", true},
+		{"v2.1.0-rc1", true},
+		{"1.0.0", false}, // gob net/rpc era
+		{"3.0.0", false},
+		{"2.0", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := CheckCompatible(tt.version); (err == nil) != tt.ok {
+			t.Errorf("CheckCompatible(%q) = %v, want ok=%v", tt.version, err, tt.ok)
+		}
+	}
+}
+
+func TestIntersectCapabilities(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want []string
+	}{
+		{LocalCapabilities, LocalCapabilities, LocalCapabilities},
+		{LocalCapabilities, BaselineCapabilities, BaselineCapabilities},
+		{[]string{"a", "b", "c"}, []string{"c", "a"}, []string{"a", "c"}},
+		{[]string{"a", "a"}, []string{"a"}, []string{"a"}},
+		{[]string{"a"}, nil, []string{}},
+		{nil, []string{"a"}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := IntersectCapabilities(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("IntersectCapabilities(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
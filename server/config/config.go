@@ -12,9 +12,58 @@ type Config struct {
 		TcpPort   int `yaml:"tcp_port"`
 		WebPort   int `yaml:"web_port"`
 		PortStart int `yaml:"port_start"`
+		// Let several sessions share one client identity instead of the newest taking over
+		AllowDuplicateSessions bool `yaml:"allow_duplicate_sessions"`
+		// Expire sessions without heartbeat for this long, 0 disables
+		SessionTimeoutSeconds int `yaml:"session_timeout_seconds"`
+		// Close a UDP peer association after this long without datagrams, default 60
+		UDPIdleTimeoutSeconds int `yaml:"udp_idle_timeout_seconds"`
 	} `yaml:"server"`
+	TLS struct {
+		Insecure bool   `yaml:"insecure"` // Plaintext TCP, lab use only
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"` // Both empty: auto-generate self-signed
+	} `yaml:"tls"`
+	Auth struct {
+		Token         string              `yaml:"token"`          // Global shared secret accepted from any project
+		ProjectTokens map[string][]string `yaml:"project_tokens"` // Project name -> tokens accepted for that project
+	} `yaml:"auth"`
+	Web struct {
+		Users        []WebUser `yaml:"users"`
+		SessionHours int       `yaml:"session_hours"` // Login lifetime, default 12
+	} `yaml:"web"`
+	HTTP struct {
+		Port   int    `yaml:"port"`   // Shared HTTP entrypoint, 0 disables
+		Domain string `yaml:"domain"` // Routes <service>.<client>.<domain>
+	} `yaml:"http"`
+	HTTPS struct {
+		Port   int    `yaml:"port"`   // TLS passthrough entrypoint routed by SNI, 0 disables
+		Domain string `yaml:"domain"` // Defaults to http.domain
+	} `yaml:"https"`
+	Store struct {
+		Type string `yaml:"type"` // json (default) | memory
+		Path string `yaml:"path"` // JSON file, default data.json
+	} `yaml:"store"`
+	Metrics struct {
+		Token string `yaml:"token"` // Bearer token required on /metrics, empty allows anyone who reaches the web port
+	} `yaml:"metrics"`
+	Update struct {
+		Dir     string `yaml:"dir"`      // Signed client builds offered to clients, default updates
+		KeyFile string `yaml:"key_file"` // ed25519 signing key for -sign-update, default update.key
+	} `yaml:"update"`
 }
 
+// WebUser is a local account for the web admin
+type WebUser struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"` // bcrypt, generate with `server -hash-password <pw>`
+	Role         string `yaml:"role"`          // viewer | operator
+}
+
+// PlaceholderToken is the auth.token older example configs shipped with.
+// The server refuses to start with it.
+const PlaceholderToken = "change-me"
+
 var GlobalConfig Config
 
 func Load() {
@@ -22,6 +71,7 @@ func Load() {
 	GlobalConfig.Server.TcpPort = 7001
 	GlobalConfig.Server.WebPort = 8080
 	GlobalConfig.Server.PortStart = 10000
+	GlobalConfig.Server.SessionTimeoutSeconds = 30
 
 	data, err := os.ReadFile("config.yaml")
 	if err != nil {
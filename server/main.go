@@ -1,28 +1,80 @@
 package main
 
 import (
+	"common"
+	"common/jsonrpc"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net"
-	"net/rpc"
 	"server/config"
+	"server/pkg/auth"
 	"server/pkg/core"
+	"server/pkg/metrics"
 	rpcHandler "server/pkg/rpc"
+	"server/pkg/store"
+	"server/pkg/transport"
+	"server/pkg/update"
+	"server/pkg/vhost"
 	"server/pkg/web"
+	"time"
 
 	"github.com/hashicorp/yamux"
 )
 
 func main() {
+	hashPassword := flag.String("hash-password", "", "print a bcrypt hash for a web admin password and exit")
+	genUpdateKey := flag.Bool("gen-update-key", false, "create the client update signing key and print its public key")
+	signUpdate := flag.String("sign-update", "", "sign a client build in the update directory and exit")
+	flag.Parse()
+	if *hashPassword != "" {
+		hash, err := auth.HashPassword(*hashPassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
 	// 1. Load Config
 	config.Load()
+	if *genUpdateKey {
+		pub, err := update.GenerateKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Public key (build clients with -ldflags \"-X client/pkg/update.TrustedKey=<key>\"):")
+		fmt.Println(pub)
+		return
+	}
+	if *signUpdate != "" {
+		if err := update.Sign(*signUpdate); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Signed", *signUpdate)
+		return
+	}
+	// The example token is public, a server using it accepts anyone
+	if config.GlobalConfig.Auth.Token == config.PlaceholderToken {
+		log.Fatalf("auth.token is still %q, set your own secret in config.yaml (or leave it empty to disable authentication)", config.PlaceholderToken)
+	}
+	if err := store.Init(); err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
 
 	// 2. Start Web Server
 	web.Start()
+	core.StartSessionReaper()
+	auth.StartSessionCleanup()
+	core.StartUsageFlusher()
+	core.StartTrafficTicker()
+	vhost.StartHTTP()
+	vhost.StartTLS()
 
 	// 3. Start TCP Listener for Clients
 	port := config.GlobalConfig.Server.TcpPort
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	listener, err := transport.Listen(port)
 	if err != nil {
 		log.Fatalf("Failed to listen on port %d: %v", port, err)
 	}
@@ -39,6 +91,18 @@ func main() {
 }
 
 func handleClient(conn net.Conn) {
+	// 0. Finish TLS handshake up front so bad clients fail fast and visibly
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			metrics.HandshakeFailures.WithLabelValues("tls").Inc()
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+
 	// 1. Setup Yamux
 	session, err := yamux.Server(conn, nil)
 	if err != nil {
@@ -46,44 +110,29 @@ func handleClient(conn net.Conn) {
 		return
 	}
 
-	// 2. Open Reverse Control Stream (Stream 1 for us, but maybe not 1 ID)
-	// Strategy:
-	// A. Client connects.
-	// B. Client Opens Stream (Control for C->S). Server Accepts.
-	// C. Server Opens Stream (Control for S->C). Client Accepts.
-
-	// Wait for Client to Open Control Stream
+	// 2. Wait for Client to Open Control Stream.
+	// It carries JSON-RPC in both directions; every stream after it is a
+	// data stream opened by us.
 	controlStream, err := session.Accept()
 	if err != nil {
 		log.Println("Failed to accept control stream:", err)
+		session.Close()
 		return
 	}
 
-	// Open Reverse Control Stream
-	reverseStream, err := session.Open()
-	if err != nil {
-		log.Println("Failed to open reverse control stream:", err)
-		return
-	}
-	rpcClient := rpc.NewClient(reverseStream)
-
+	peer := jsonrpc.NewPeer(controlStream, common.Schemas)
 	handler := &rpcHandler.ServerRPCContext{
-		Session:   session,
-		RPCClient: rpcClient,
-		Conn:      conn,
+		Session: session,
+		Peer:    peer,
+		Conn:    conn,
 	}
+	handler.Register()
 
-	// Re-register for this connection specifically?
-	// `rpc.NewServer()` creates a new server instance.
-	// `server.RegisterName("ServerRPC", handler)`
-
-	singleServer := rpc.NewServer()
-	singleServer.RegisterName("ServerRPCContext", handler) // Match Client's call
-
-	// Wait for handshake? No, just serve.
+	// Run blocks until the client disconnects.
 	// The handler's Handshake method will have access to `handler.Session`.
-	// ServeConn blocks until client disconnects
-	singleServer.ServeConn(controlStream)
+	if err := peer.Run(); err != nil {
+		log.Println("Control stream error:", err)
+	}
 
 	// Clean up on disconnect
 	log.Println("Client disconnected (control stream closed)")
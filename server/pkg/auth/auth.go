@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"server/config"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles, ordered by privilege
+const (
+	RoleViewer   = "viewer"   // Read-only access to clients and services
+	RoleOperator = "operator" // May change services and act on sessions
+)
+
+var roleLevel = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+}
+
+// Session is a logged-in web admin user
+type Session struct {
+	Token    string
+	Username string
+	Role     string
+	Expires  time.Time
+}
+
+var (
+	sessions     = make(map[string]*Session) // Token -> Session
+	sessionsLock sync.Mutex
+
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+// HasRole reports whether role grants at least the required privilege
+func HasRole(role, required string) bool {
+	return roleLevel[role] > 0 && roleLevel[role] >= roleLevel[required]
+}
+
+// Verify checks username/password against the configured users and returns the user's role
+func Verify(username, password string) (string, error) {
+	for _, u := range config.GlobalConfig.Web.Users {
+		if u.Username != username {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+			return "", ErrInvalidCredentials
+		}
+		if roleLevel[u.Role] == 0 {
+			return "", errors.New("user has unknown role: " + u.Role)
+		}
+		return u.Role, nil
+	}
+	// Burn the same time as a real comparison so usernames can't be probed
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	return "", ErrInvalidCredentials
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("fffrp"), bcrypt.DefaultCost)
+
+// HashPassword returns a bcrypt hash suitable for config.yaml
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Login verifies credentials and creates a new session
+func Login(username, password string) (*Session, error) {
+	role, err := Verify(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		Token:    hex.EncodeToString(buf),
+		Username: username,
+		Role:     role,
+		Expires:  time.Now().Add(sessionTTL()),
+	}
+
+	sessionsLock.Lock()
+	sessions[s.Token] = s
+	sessionsLock.Unlock()
+	return s, nil
+}
+
+// Lookup returns the session for a token, or nil if unknown or expired
+func Lookup(token string) *Session {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	s, ok := sessions[token]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.Expires) {
+		delete(sessions, token)
+		return nil
+	}
+	return s
+}
+
+// Logout removes a session
+func Logout(token string) {
+	sessionsLock.Lock()
+	delete(sessions, token)
+	sessionsLock.Unlock()
+}
+
+// StartSessionCleanup drops expired sessions every few minutes. Lookup only
+// removes the ones someone still presents, abandoned logins would pile up.
+func StartSessionCleanup() {
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			pruneSessions()
+		}
+	}()
+}
+
+func pruneSessions() {
+	now := time.Now()
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for token, s := range sessions {
+		if now.After(s.Expires) {
+			delete(sessions, token)
+		}
+	}
+}
+
+func sessionTTL() time.Duration {
+	hours := config.GlobalConfig.Web.SessionHours
+	if hours <= 0 {
+		hours = 12
+	}
+	return time.Duration(hours) * time.Hour
+}
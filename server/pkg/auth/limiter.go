@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter blocks a remote address after too many failed attempts (tokens,
+// passwords) within a window, so secrets can't be guessed at line rate
+type Limiter struct {
+	max    int
+	window time.Duration
+
+	lock     sync.Mutex
+	failures map[string]*failureCount // Remote host -> failures in the current window
+}
+
+type failureCount struct {
+	count int
+	first time.Time
+}
+
+// NewLimiter allows max failures per remote host within window
+func NewLimiter(max int, window time.Duration) *Limiter {
+	return &Limiter{max: max, window: window, failures: make(map[string]*failureCount)}
+}
+
+// Allowed reports whether addr may try again
+func (l *Limiter) Allowed(addr string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	f, ok := l.failures[remoteHost(addr)]
+	return !ok || time.Since(f.first) > l.window || f.count < l.max
+}
+
+// Fail records a failed attempt from addr
+func (l *Limiter) Fail(addr string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Forget windows that are over, so the map only holds recent offenders
+	now := time.Now()
+	for host, f := range l.failures {
+		if now.Sub(f.first) > l.window {
+			delete(l.failures, host)
+		}
+	}
+
+	host := remoteHost(addr)
+	if f, ok := l.failures[host]; ok {
+		f.count++
+	} else {
+		l.failures[host] = &failureCount{count: 1, first: now}
+	}
+}
+
+// Succeed clears the failures of addr
+func (l *Limiter) Succeed(addr string) {
+	l.lock.Lock()
+	delete(l.failures, remoteHost(addr))
+	l.lock.Unlock()
+}
+
+// remoteHost strips the port: reconnecting from a new port is the same client
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"server/pkg/store"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Connection is one active visitor connection carried by a data stream
+type Connection struct {
+	ID        uint64    `json:"id"`
+	ClientID  string    `json:"client_id"`
+	Identity  string    `json:"identity"`
+	ServiceID string    `json:"service_id"` // "dynamic" for SOCKS5/HTTP proxy streams
+	Protocol  string    `json:"protocol"`
+	Visitor   string    `json:"visitor"` // Public peer address, "" for pooled HTTP entrypoint streams
+	Target    string    `json:"target"`
+	Start     time.Time `json:"start"`
+	BytesIn   int64     `json:"bytes_in"`  // Visitor -> target
+	BytesOut  int64     `json:"bytes_out"` // Target -> visitor
+}
+
+// usageFlushInterval is how often traffic totals are written to the store.
+// At most this much accounting is lost if the server dies.
+const usageFlushInterval = time.Minute
+
+var (
+	conns     = make(map[uint64]*meteredConn) // Active data streams by connection ID
+	nextConn  uint64
+	connsLock sync.Mutex
+
+	// Traffic of closed streams not yet written to the store, guarded by connsLock
+	pendingUsage = make(map[usageKey]store.Traffic)
+)
+
+type usageKey struct {
+	identity  string
+	serviceID string
+}
+
+// ListConnections returns the active connections, oldest first.
+// clientID filters by session; "" returns all.
+func ListConnections(clientID string) []Connection {
+	connsLock.Lock()
+	list := []Connection{}
+	for _, m := range conns {
+		if clientID != "" && m.info.ClientID != clientID {
+			continue
+		}
+		c := m.info
+		c.BytesIn, c.BytesOut = m.bytesIn.Load(), m.bytesOut.Load()
+		list = append(list, c)
+	}
+	connsLock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CloseConnection closes one active connection. The pipes serving it notice
+// the closed stream and close the visitor side.
+func CloseConnection(id uint64) error {
+	connsLock.Lock()
+	m, ok := conns[id]
+	connsLock.Unlock()
+	if !ok {
+		return fmt.Errorf("connection %d not found", id)
+	}
+	log.Printf("[Core] Closing connection %d (%s -> %s %s)", id, m.info.Visitor, m.info.ClientID, m.info.Target)
+	return m.Close()
+}
+
+// trackConn registers a new stream and assigns its connection ID
+func trackConn(m *meteredConn) {
+	connsLock.Lock()
+	nextConn++
+	m.info.ID = nextConn
+	conns[m.info.ID] = m
+	connsLock.Unlock()
+
+	emit(EventConnectionOpened, m.info)
+}
+
+// untrackConn removes a closed stream and keeps its unflushed traffic
+func untrackConn(m *meteredConn) {
+	connsLock.Lock()
+	delete(conns, m.info.ID)
+	collectUsage(m)
+	connsLock.Unlock()
+
+	final := m.info
+	final.BytesIn, final.BytesOut = m.bytesIn.Load(), m.bytesOut.Load()
+	emit(EventConnectionClosed, final)
+}
+
+// collectUsage moves traffic not yet accounted for into pendingUsage.
+// Caller must hold connsLock.
+func collectUsage(m *meteredConn) {
+	in, out := m.bytesIn.Load(), m.bytesOut.Load()
+	delta := store.Traffic{In: in - m.accounted.In, Out: out - m.accounted.Out}
+	if delta.In == 0 && delta.Out == 0 {
+		return
+	}
+	m.accounted = store.Traffic{In: in, Out: out}
+
+	key := usageKey{identity: m.info.Identity, serviceID: m.info.ServiceID}
+	t := pendingUsage[key]
+	pendingUsage[key] = store.Traffic{In: t.In + delta.In, Out: t.Out + delta.Out}
+}
+
+// FlushUsage writes the traffic since the last flush, including that of
+// still open streams, to the per-service daily and monthly totals
+func FlushUsage() {
+	connsLock.Lock()
+	for _, m := range conns {
+		collectUsage(m)
+	}
+	now := time.Now()
+	deltas := make([]store.UsageDelta, 0, len(pendingUsage))
+	for key, t := range pendingUsage {
+		deltas = append(deltas, store.UsageDelta{Identity: key.identity, ServiceID: key.serviceID, Time: now, Traffic: t})
+	}
+	pendingUsage = make(map[usageKey]store.Traffic)
+	connsLock.Unlock()
+
+	if err := store.Default.AddUsage(deltas); err != nil {
+		log.Printf("[Core] Failed to persist traffic totals: %v", err)
+	}
+}
+
+// StartUsageFlusher persists traffic totals periodically
+func StartUsageFlusher() {
+	go func() {
+		ticker := time.NewTicker(usageFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			FlushUsage()
+		}
+	}()
+}
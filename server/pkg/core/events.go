@@ -0,0 +1,73 @@
+package core
+
+import (
+	"common"
+	"time"
+)
+
+// Events pushed to the Web UI through OnEvent, with the type of their data
+const (
+	EventClientConnected    = "client_connected"    // ClientEvent
+	EventClientUpdated      = "client_updated"      // ClientEvent: health, stream errors or proxies changed
+	EventClientDisconnected = "client_disconnected" // ClientEvent
+	EventServicesChanged    = "services_changed"    // ServicesEvent
+	EventConnectionOpened   = "connection_opened"   // Connection
+	EventConnectionClosed   = "connection_closed"   // Connection, with its final byte counts
+	EventTrafficTick        = "traffic_tick"        // []TrafficCount of all open connections
+)
+
+// ClientEvent names the client a client_* event is about
+type ClientEvent struct {
+	ID       string `json:"id"`
+	Identity string `json:"identity"`
+}
+
+// ServicesEvent carries a client's new service list
+type ServicesEvent struct {
+	ClientID string                 `json:"client_id"`
+	Services []common.TargetService `json:"services"`
+}
+
+// TrafficCount is the byte count of one open connection
+type TrafficCount struct {
+	ID       uint64 `json:"id"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+// trafficTickInterval is how often byte counts of open connections are pushed
+const trafficTickInterval = 2 * time.Second
+
+// OnEvent is called for every change the Web UI shows.
+// Never called with ClientsLock, ListenerLock or connsLock held.
+var OnEvent func(event string, data interface{})
+
+func emit(event string, data interface{}) {
+	if OnEvent != nil {
+		OnEvent(event, data)
+	}
+}
+
+func emitClient(event string, client *ClientSession) {
+	emit(event, ClientEvent{ID: client.ID, Identity: client.Identity})
+}
+
+// StartTrafficTicker pushes byte counts of open connections while there are any
+func StartTrafficTicker() {
+	go func() {
+		ticker := time.NewTicker(trafficTickInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			connsLock.Lock()
+			counts := make([]TrafficCount, 0, len(conns))
+			for id, m := range conns {
+				counts = append(counts, TrafficCount{ID: id, BytesIn: m.bytesIn.Load(), BytesOut: m.bytesOut.Load()})
+			}
+			connsLock.Unlock()
+
+			if len(counts) > 0 {
+				emit(EventTrafficTick, counts)
+			}
+		}
+	}()
+}
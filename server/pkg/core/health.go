@@ -0,0 +1,52 @@
+package core
+
+import (
+	"log"
+	"server/config"
+	"time"
+)
+
+// Touch records activity from a client, with the link stats it reported
+func Touch(clientID string, rttMs int64, missedBeats int) {
+	ClientsLock.Lock()
+	client, exists := Clients[clientID]
+	changed := false
+	if exists {
+		changed = client.MissedBeats != missedBeats
+		client.LastSeen = time.Now()
+		client.RTTMs = rttMs
+		client.MissedBeats = missedBeats
+	}
+	ClientsLock.Unlock()
+
+	// Every beat would make the Web UI refetch, only notify when health changes
+	if changed {
+		emitClient(EventClientUpdated, client)
+	}
+}
+
+// StartSessionReaper closes sessions that have gone quiet for longer than
+// the configured timeout. Closing the session ends its control stream,
+// which runs the normal RemoveClientBySession cleanup.
+func StartSessionReaper() {
+	timeout := time.Duration(config.GlobalConfig.Server.SessionTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		log.Println("[Core] Session timeout disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(timeout / 3)
+		defer ticker.Stop()
+		for range ticker.C {
+			ClientsLock.RLock()
+			for id, client := range Clients {
+				if idle := time.Since(client.LastSeen); idle > timeout {
+					log.Printf("[Core] Client %s silent for %v, expiring session", id, idle.Round(time.Second))
+					client.Session.Close()
+				}
+			}
+			ClientsLock.RUnlock()
+		}
+	}()
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"bufio"
+	"common"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// hopHeaders are per-connection headers a proxy must not forward
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// serveHTTPProxy handles one HTTP proxy visitor: CONNECT tunnels and plain
+// forward requests with absolute URLs. Every upstream connection is a
+// dynamic data stream dialed by the client, as with SOCKS5.
+func serveHTTPProxy(conn net.Conn, clientID string) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// Own transport per visitor: pooled upstream streams must never be shared between clients
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return DialTarget(clientID, addr, conn)
+		},
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+	defer transport.CloseIdleConnections()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(proxyHandshakeTimeout))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if !proxyRequestAuthorized(req) {
+			writeProxyError(conn, http.StatusProxyAuthRequired, "proxy authentication required",
+				"Proxy-Authenticate", `Basic realm="fffrp"`)
+			return
+		}
+
+		if req.Method == http.MethodConnect {
+			tunnelHTTPConnect(conn, br, req, clientID)
+			return
+		}
+
+		if !req.URL.IsAbs() {
+			writeProxyError(conn, http.StatusBadRequest, "this is a proxy, absolute URL required")
+			return
+		}
+		if !forwardHTTPRequest(conn, req, transport, clientID) {
+			return
+		}
+	}
+}
+
+// tunnelHTTPConnect answers CONNECT host:port and pipes raw bytes
+func tunnelHTTPConnect(conn net.Conn, br *bufio.Reader, req *http.Request, clientID string) {
+	target := req.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "443")
+	}
+
+	stream, err := DialTarget(clientID, target, conn)
+	if err != nil {
+		log.Printf("[HTTPProxy] CONNECT %s via client %s failed: %v", target, clientID, err)
+		writeProxyError(conn, httpStatusForError(err), err.Error())
+		return
+	}
+	defer stream.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// br may already hold bytes the visitor sent after the request head
+		io.Copy(stream, br)
+		stream.Close()
+		close(done)
+	}()
+	io.Copy(conn, stream)
+	conn.Close()
+	<-done
+}
+
+// forwardHTTPRequest relays one plain proxy request. Returns false when
+// the visitor connection must not be reused.
+func forwardHTTPRequest(conn net.Conn, req *http.Request, transport *http.Transport, clientID string) bool {
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.RequestURI = ""
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		log.Printf("[HTTPProxy] %s %s via client %s failed: %v", req.Method, req.URL, clientID, err)
+		writeProxyError(conn, httpStatusForError(err), err.Error())
+		return false
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		if h != "Transfer-Encoding" {
+			resp.Header.Del(h)
+		}
+	}
+	if err := resp.Write(conn); err != nil {
+		return false
+	}
+	return !req.Close && !resp.Close
+}
+
+// proxyRequestAuthorized checks Proxy-Authorization: Basic against web operators
+func proxyRequestAuthorized(req *http.Request) bool {
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return false
+	}
+	// Reuse net/http's Basic parser on a throwaway request
+	probe := &http.Request{Header: http.Header{"Authorization": {header}}}
+	username, password, ok := probe.BasicAuth()
+	return ok && proxyAuth(username, password)
+}
+
+func writeProxyError(conn net.Conn, code int, message string, extraHeader ...string) {
+	resp := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\n", code, http.StatusText(code))
+	for i := 0; i+1 < len(extraHeader); i += 2 {
+		resp += extraHeader[i] + ": " + extraHeader[i+1] + "\r\n"
+	}
+	resp += fmt.Sprintf("Content-Length: %d\r\n\r\n%s\n", len(message)+1, message)
+	io.WriteString(conn, resp)
+}
+
+func httpStatusForError(err error) int {
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) {
+		return http.StatusBadGateway
+	}
+	switch dialErr.Code {
+	case common.StatusRefused:
+		return http.StatusForbidden
+	case common.StatusTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
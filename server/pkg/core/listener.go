@@ -0,0 +1,133 @@
+package core
+
+import (
+	"common"
+	"fmt"
+	"log"
+	"net"
+)
+
+// publicListener is a public TCP port serving a service or a dynamic proxy.
+// Its owner is read for every accepted connection, so the session can
+// re-point the port to another of its services without a second accept loop.
+// Another session gets the port only after StopPublicListener closed it.
+type publicListener struct {
+	ln   net.Listener
+	port int
+
+	// Owner, guarded by ListenerLock
+	clientID  string
+	serviceID string                 // "" for proxies
+	proxy     func(net.Conn, string) // Proxy handler, nil for services
+}
+
+func (pl *publicListener) acceptLoop() {
+	for {
+		conn, err := pl.ln.Accept()
+		if err != nil {
+			return // Closed by stopServiceListener
+		}
+
+		ListenerLock.Lock()
+		clientID, serviceID, proxy := pl.clientID, pl.serviceID, pl.proxy
+		ListenerLock.Unlock()
+
+		if proxy != nil {
+			go proxy(conn, clientID)
+		} else {
+			go handleUserConnection(conn, pl.port, clientID, serviceID)
+		}
+	}
+}
+
+// listenTCP opens a public TCP port for an owner. A port the same session
+// already listens on is re-pointed to the new service or proxy; a port owned
+// by another session is refused, it only changes hands once that owner has
+// stopped it. Caller must hold ListenerLock.
+func listenTCP(port int, clientID, serviceID string, proxy func(net.Conn, string)) error {
+	if pl, exists := Listeners[port]; exists {
+		if pl.clientID != clientID {
+			log.Printf("[Core] Port %d belongs to client %s, refusing it to client %s", port, pl.clientID, clientID)
+			return fmt.Errorf("port %d belongs to another client", port)
+		}
+		if pl.serviceID != serviceID {
+			log.Printf("[Core] Port %d of client %s reassigned from %q to %q", port, clientID, pl.serviceID, serviceID)
+		}
+		pl.serviceID, pl.proxy = serviceID, proxy
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Printf("[Core] Failed to listen on port %d: %v", port, err)
+		return err
+	}
+	pl := &publicListener{ln: ln, port: port, clientID: clientID, serviceID: serviceID, proxy: proxy}
+	Listeners[port] = pl
+	go pl.acceptLoop()
+	return nil
+}
+
+// StartPublicListener starts a listener on the server for a specific client target.
+// A port this client already listens on is re-pointed to the service.
+func StartPublicListener(port int, clientID string, svc common.TargetService) error {
+	if svc.Proto() == common.ProtocolUDP {
+		if client, ok := clientWithout(clientID, common.CapUDP); ok {
+			log.Printf("[Core] Client %s does not support UDP, not listening on port %d", clientID, port)
+			recordStreamResult(client, svc.ID, common.StatusUnsupported, "client does not support UDP, please upgrade it")
+			return fmt.Errorf("client %s does not support UDP", clientID)
+		}
+		return startUDPListener(port, clientID, svc)
+	}
+
+	ListenerLock.Lock()
+	defer ListenerLock.Unlock()
+
+	_, existed := Listeners[port]
+	if err := listenTCP(port, clientID, svc.ID, nil); err != nil {
+		return err
+	}
+	if !existed {
+		log.Printf("[Core] Listening on public port %d for client %s -> %s:%d", port, clientID, svc.LocalIP, svc.LocalPort)
+	}
+	return nil
+}
+
+// StopPublicListener stops the listeners on port owned by clientID.
+// A port that was handed to another owner in the meantime is left alone.
+func StopPublicListener(port int, clientID string) {
+	stopServiceListener(port, "", clientID)
+}
+
+// stopServiceListener closes the TCP or UDP listener on port owned by clientID,
+// "" protocol for both. One protocol only is for a service moving between
+// TCP and UDP on the same port.
+func stopServiceListener(port int, protocol, clientID string) {
+	ListenerLock.Lock()
+	defer ListenerLock.Unlock()
+
+	stopped := false
+	if pl, exists := Listeners[port]; exists && protocol != common.ProtocolUDP {
+		if pl.clientID == clientID {
+			pl.ln.Close()
+			delete(Listeners, port)
+			log.Printf("[Core] Stopped listener on port %d", port)
+		} else {
+			log.Printf("[Core] Port %d now belongs to client %s, not stopping it for %s", port, pl.clientID, clientID)
+		}
+		stopped = true
+	}
+	if ul, exists := UDPListeners[port]; exists && protocol != common.ProtocolTCP {
+		if ul.clientID == clientID {
+			ul.Close()
+			delete(UDPListeners, port)
+			log.Printf("[Core] Stopped UDP listener on port %d", port)
+		} else {
+			log.Printf("[Core] UDP port %d now belongs to client %s, not stopping it for %s", port, ul.clientID, clientID)
+		}
+		stopped = true
+	}
+	if !stopped {
+		log.Printf("[Core] Warning: Attempted to stop listener on port %d but not found in map", port)
+	}
+}
@@ -2,23 +2,47 @@ package core
 
 import (
 	"common"
+	"common/jsonrpc"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/rpc"
 	"server/config"
+	"server/pkg/metrics"
+	"server/pkg/store"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/yamux"
 )
 
 // ClientSession manages a connected client
 type ClientSession struct {
-	ID        string
-	Session   *yamux.Session
-	RPCClient *rpc.Client // For S->C calls
-	Services  []common.TargetService
+	ID       string
+	Identity string // Stable key for persisted state, survives reconnects
+	Persist  bool   // False for a duplicate session of an identity that is already online
+	Session  *yamux.Session
+	Peer     *jsonrpc.Peer // Control stream, for S->C calls and notifications
+	Services []common.TargetService
+
+	// Client version and the capabilities negotiated in the handshake
+	Version      string
+	Capabilities []string
+
+	// Last data stream failure per service ID, cleared on success
+	StreamErrors map[string]StreamError
+
+	// Service IDs the client's user has not approved yet, as the client reported them
+	Unapproved []string
+
+	// Dynamic proxies opened for this client: kind -> public port
+	Proxies map[string]int
+
+	// Link Health, reported by client heartbeats
+	LastSeen    time.Time
+	RTTMs       int64
+	MissedBeats int
 
 	// User Info
 	Name        string
@@ -27,57 +51,97 @@ type ClientSession struct {
 	Remark      string
 }
 
+// Has reports whether a capability was negotiated for this session
+func (c *ClientSession) Has(capability string) bool {
+	return common.HasCapability(c.Capabilities, capability)
+}
+
+// StreamError records why the client could not serve a data stream
+type StreamError struct {
+	Time   time.Time `json:"time"`
+	Code   uint8     `json:"code"`
+	Reason string    `json:"reason"`
+}
+
+// streamStatusTimeout bounds how long we wait for the client's dial result.
+// Must exceed the client's own dial timeout.
+const streamStatusTimeout = 15 * time.Second
+
 var (
-	Clients        = make(map[string]*ClientSession)
-	ClientsLock    sync.RWMutex
-	Listeners      = make(map[int]net.Listener) // Public Port -> Listener
-	ListenerLock   sync.Mutex
-	OnClientUpdate func()
+	Clients      = make(map[string]*ClientSession)
+	ClientsLock  sync.RWMutex
+	Listeners    = make(map[int]*publicListener) // Public Port -> TCP Listener
+	UDPListeners = make(map[int]*udpListener)    // Public Port -> UDP Relay, guarded by ListenerLock
+	ListenerLock sync.Mutex
 )
 
-// AddClient registers a new client
-func AddClient(id string, session *yamux.Session, rpcClient *rpc.Client, name, phone, projectName, remark string) *ClientSession {
+// AddClient registers a new client.
+// Services and public ports stored for identity are restored and their listeners reopened.
+func AddClient(id, identity string, session *yamux.Session, peer *jsonrpc.Peer, name, phone, projectName, remark, version string, capabilities []string) *ClientSession {
 	ClientsLock.Lock()
-	defer ClientsLock.Unlock()
 
-	// If exists, remove old one first?
-	// Change: We now allow multiple clients. But if ID is EXACTLY same, we overwrite.
-	// But in rpc/handler.go we are generating unique ID (with timestamp/IP).
-	// So effectively every connection is unique.
+	// If exists, the client reconnected: take over and close the old session.
+	// The session ID is the client identity unless duplicate sessions are allowed,
+	// in which case rpc/handler.go makes every connection unique.
 
 	if old, exists := Clients[id]; exists {
-		log.Printf("[Core] Client %s re-connected (ID collision), closing old session", id)
+		log.Printf("[Core] Client %s re-connected, taking over old session", id)
 		// Clean up listeners for old client!
 		for _, svc := range old.Services {
-			StopPublicListener(svc.RemotePort)
+			StopPublicListener(svc.RemotePort, id)
+		}
+		for _, port := range old.Proxies {
+			StopPublicListener(port, id)
 		}
 		old.Session.Close()
 		delete(Clients, id)
 	}
 
 	client := &ClientSession{
-		ID:          id,
-		Session:     session,
-		RPCClient:   rpcClient,
-		Services:    []common.TargetService{},
-		Name:        name,
-		Phone:       phone,
-		ProjectName: projectName,
-		Remark:      remark,
+		ID:           id,
+		Identity:     identity,
+		Session:      session,
+		Peer:         peer,
+		Version:      version,
+		Capabilities: capabilities,
+		Services:     []common.TargetService{},
+		StreamErrors: make(map[string]StreamError),
+		Proxies:      make(map[string]int),
+		LastSeen:     time.Now(),
+		Name:         name,
+		Phone:        phone,
+		ProjectName:  projectName,
+		Remark:       remark,
+	}
+
+	// Only the first live session of an identity owns its persisted state,
+	// otherwise two sessions would fight over the same public ports
+	client.Persist = !identityOnline(identity, nil)
+	if !client.Persist {
+		log.Printf("[Core] Identity %s already online, session %s will not restore or persist services", identity, id)
+	} else if rec, found := store.Default.Get(identity); found {
+		client.Services = append([]common.TargetService{}, rec.Services...)
+		for kind, port := range rec.Proxies {
+			client.Proxies[kind] = port
+		}
+		log.Printf("[Core] Restored %d services for identity %s", len(rec.Services), identity)
 	}
+
 	Clients[id] = client
+	saveClientRecord(client)
 	log.Printf("[Core] Client %s registered with session ptr: %p", id, session)
+	ClientsLock.Unlock()
+	flushClientRecords()
 
-	if OnClientUpdate != nil {
-		OnClientUpdate()
-	}
+	startListeners(id)
+
+	emitClient(EventClientConnected, client)
 	return client
 }
 
 // RemoveClientBySession finds and removes a client by session
 func RemoveClientBySession(session *yamux.Session) {
 	ClientsLock.Lock()
-	defer ClientsLock.Unlock()
 
 	log.Printf("[Core] RemoveClientBySession called with session ptr: %p", session)
 
@@ -98,33 +162,50 @@ func RemoveClientBySession(session *yamux.Session) {
 		// Close all listeners
 		for _, svc := range foundClient.Services {
 			log.Printf("[Core] Cleanup: Stopping listener for service %s on port %d", svc.ID, svc.RemotePort)
-			StopPublicListener(svc.RemotePort)
+			StopPublicListener(svc.RemotePort, targetID)
 		}
+		for kind, port := range foundClient.Proxies {
+			log.Printf("[Core] Cleanup: Stopping %s proxy on port %d", kind, port)
+			StopPublicListener(port, targetID)
+		}
+
+		// Keep services and ports in the store for the next reconnect
+		saveClientRecord(foundClient)
 
 		delete(Clients, targetID)
 		foundClient.Session.Close() // Ensure closed
 	} else {
+		ClientsLock.Unlock()
 		log.Printf("[Core] Warning: Session disconnect but no client found for session ptr: %p", session)
-		// ...
+		return
 	}
+	ClientsLock.Unlock()
+	flushClientRecords()
 
-	if OnClientUpdate != nil {
-		OnClientUpdate()
-	}
+	emitClient(EventClientDisconnected, foundClient)
 }
 
-// StopPublicListener stops a listener
-func StopPublicListener(port int) {
-	ListenerLock.Lock()
-	defer ListenerLock.Unlock()
+// DisconnectClient closes a client's session on behalf of an operator.
+// The client is told the reason first and does not reconnect on its own;
+// closing the session runs the normal RemoveClientBySession cleanup.
+func DisconnectClient(clientID, reason string) error {
+	ClientsLock.RLock()
+	client, exists := Clients[clientID]
+	ClientsLock.RUnlock()
+	if !exists {
+		return fmt.Errorf("client %s not connected", clientID)
+	}
 
-	if ln, exists := Listeners[port]; exists {
-		ln.Close()
-		delete(Listeners, port)
-		log.Printf("[Core] Stopped listener on port %d", port)
-	} else {
-		log.Printf("[Core] Warning: Attempted to stop listener on port %d but not found in map", port)
+	log.Printf("[Core] Disconnecting client %s: %s", clientID, reason)
+	if err := client.Peer.Notify(common.MethodDisconnect, &common.DisconnectArgs{Reason: reason}); err != nil {
+		log.Printf("[Core] Failed to tell client %s about the disconnect: %v", clientID, err)
 	}
+	return client.Session.Close()
+}
+
+// listenerMoved reports whether a service edit needs a different public listener
+func listenerMoved(old, cur common.TargetService) bool {
+	return old.RemotePort != cur.RemotePort || old.Proto() != cur.Proto()
 }
 
 // UpdateServices updates the service list for a client and manages listeners
@@ -145,14 +226,27 @@ func UpdateServices(clientID string, services []common.TargetService) {
 
 	// Update new services
 	updatedServices := make([]common.TargetService, len(services))
+	claimed := make(map[int]bool) // Ports given out in this list
 	for i, svc := range services {
+		// A port the service didn't have yet is only taken if nobody else
+		// owns or reserves it, otherwise the service gets a fresh one
+		if old, ok := oldServices[svc.ID]; svc.RemotePort != 0 && (!ok || old.RemotePort != svc.RemotePort) {
+			err := portUsable(client, svc.RemotePort)
+			if err == nil && claimed[svc.RemotePort] {
+				err = fmt.Errorf("port %d is used by another service in the list", svc.RemotePort)
+			}
+			if err != nil {
+				log.Printf("[Core] Service %s cannot have port %d (%v), allocating another", svc.ID, svc.RemotePort, err)
+				svc.RemotePort = 0
+			}
+		}
 		if svc.RemotePort == 0 {
 			// Check if we have an existing allocation for this ID
 			if old, ok := oldServices[svc.ID]; ok && old.RemotePort != 0 {
 				svc.RemotePort = old.RemotePort
 			} else {
 				// Allocate new
-				port, err := AllocatePort()
+				port, err := allocatePort(claimed)
 				if err != nil {
 					log.Printf("[Core] Failed to allocate port for service %s: %v", svc.ID, err)
 					// Skip or keep 0? Keep 0 and maybe fail later or try again next time
@@ -161,6 +255,9 @@ func UpdateServices(clientID string, services []common.TargetService) {
 				}
 			}
 		}
+		if svc.RemotePort != 0 {
+			claimed[svc.RemotePort] = true
+		}
 		updatedServices[i] = svc
 	}
 
@@ -173,113 +270,290 @@ func UpdateServices(clientID string, services []common.TargetService) {
 
 	log.Printf("[Core] UpdateServices Check: Client has %d old services, %d new services", len(client.Services), len(updatedServices))
 
+	newServices := make(map[string]common.TargetService)
+	for _, svc := range updatedServices {
+		newServices[svc.ID] = svc
+	}
+	// Listeners of edited services are only stopped once their replacement is up
+	var moved []common.TargetService
 	for _, oldSvc := range client.Services {
 		if !newServiceIDs[oldSvc.ID] {
 			log.Printf("[Core] Service %s removed, stopping listener on port %d", oldSvc.ID, oldSvc.RemotePort)
-			StopPublicListener(oldSvc.RemotePort)
-		} else {
-			// Check if port changed (should not happen usually but good to check)
-			// ...
+			StopPublicListener(oldSvc.RemotePort, clientID)
+		} else if listenerMoved(oldSvc, newServices[oldSvc.ID]) && oldSvc.RemotePort != 0 {
+			moved = append(moved, oldSvc)
 		}
 	}
 
 	client.Services = updatedServices
+	saveClientRecord(client)
 	ClientsLock.Unlock()
+	flushClientRecords()
 
 	// Notify Web UI
-	if OnClientUpdate != nil {
-		OnClientUpdate()
-	}
+	emit(EventServicesChanged, ServicesEvent{ClientID: clientID, Services: append([]common.TargetService{}, updatedServices...)})
 
-	// 2. Open new ports
+	// 2. Open new ports, then retire the ones edited services moved away from
 	for _, svc := range updatedServices {
 		if svc.RemotePort != 0 {
-			StartPublicListener(svc.RemotePort, clientID, svc.LocalIP, svc.LocalPort)
+			StartPublicListener(svc.RemotePort, clientID, svc)
 		}
 	}
+	for _, oldSvc := range moved {
+		log.Printf("[Core] Service %s moved off %s port %d", oldSvc.ID, oldSvc.Proto(), oldSvc.RemotePort)
+		stopServiceListener(oldSvc.RemotePort, oldSvc.Proto(), clientID)
+	}
 }
 
-// AllocatePort finds an available port starting from config
-func AllocatePort() (int, error) {
-	ListenerLock.Lock()
-	defer ListenerLock.Unlock()
+// UpdateService edits one service in place (web PUT). A new RemotePort or
+// protocol gets its listener before the old one is stopped, and if it cannot
+// be opened nothing changes. Target edits apply to new connections; open
+// ones keep their data streams. Returns the stored service.
+func UpdateService(clientID string, svc common.TargetService) (common.TargetService, error) {
+	ClientsLock.RLock()
+	client, exists := Clients[clientID]
+	if !exists {
+		ClientsLock.RUnlock()
+		return svc, fmt.Errorf("client %s not connected", clientID)
+	}
+	var old common.TargetService
+	found := false
+	for _, s := range client.Services {
+		if s.ID == svc.ID {
+			old, found = s, true
+			break
+		}
+	}
+	var portErr error
+	if found && svc.RemotePort == 0 {
+		svc.RemotePort = old.RemotePort
+	} else if found && svc.RemotePort != old.RemotePort {
+		portErr = portUsable(client, svc.RemotePort)
+	}
+	ClientsLock.RUnlock()
+	if !found {
+		return svc, fmt.Errorf("service %s not found", svc.ID)
+	}
+	if portErr != nil {
+		return svc, portErr
+	}
 
-	start := config.GlobalConfig.Server.PortStart
-	if start <= 0 {
-		start = 10000
+	// Bring up the new listener first, the old one keeps serving until then
+	if listenerMoved(old, svc) {
+		if err := StartPublicListener(svc.RemotePort, clientID, svc); err != nil {
+			return svc, err
+		}
 	}
 
-	for port := start; port < 65535; port++ {
-		if _, exists := Listeners[port]; !exists {
-			// Double check if actually available
-			ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-			if err == nil {
-				ln.Close()
-				return port, nil
-			}
+	ClientsLock.Lock()
+	for i, s := range client.Services {
+		if s.ID == svc.ID {
+			client.Services[i] = svc
 		}
 	}
-	return 0, fmt.Errorf("no available ports")
+	saveClientRecord(client)
+	services := append([]common.TargetService{}, client.Services...)
+	ClientsLock.Unlock()
+	flushClientRecords()
+
+	if listenerMoved(old, svc) && old.RemotePort != 0 {
+		log.Printf("[Core] Service %s moved from %s port %d to %s port %d", svc.ID, old.Proto(), old.RemotePort, svc.Proto(), svc.RemotePort)
+		stopServiceListener(old.RemotePort, old.Proto(), clientID)
+	}
+	emit(EventServicesChanged, ServicesEvent{ClientID: clientID, Services: services})
+	return svc, nil
 }
 
-// StartPublicListener starts a listener on the server for a specific client target
-func StartPublicListener(port int, clientID string, targetIP string, targetPort int) {
-	ListenerLock.Lock()
-	defer ListenerLock.Unlock()
+// PortUsable checks a public port chosen for a new service of a client is free:
+// not used by the client itself, not reserved for another identity, not listening.
+func PortUsable(clientID string, port int) error {
+	ClientsLock.RLock()
+	defer ClientsLock.RUnlock()
+	client, exists := Clients[clientID]
+	if !exists {
+		return fmt.Errorf("client %s not connected", clientID)
+	}
+	return portUsable(client, port)
+}
 
-	if _, exists := Listeners[port]; exists {
-		return // Already listening
+// portUsable checks a public port can be given to a service of client.
+// Caller must hold ClientsLock.
+func portUsable(client *ClientSession, port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	for _, s := range client.Services {
+		if s.RemotePort == port {
+			return fmt.Errorf("port %d is used by service %s", port, s.ID)
+		}
+	}
+	for kind, p := range client.Proxies {
+		if p == port {
+			return fmt.Errorf("port %d is used by the %s proxy", port, kind)
+		}
+	}
+	if owner, taken := store.ReservedPorts()[port]; taken && owner != client.Identity {
+		return fmt.Errorf("port %d is reserved for client %s", port, owner)
 	}
 
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		log.Printf("[Core] Failed to listen on port %d: %v", port, err)
-		return
+	ListenerLock.Lock()
+	defer ListenerLock.Unlock()
+	_, tcpTaken := Listeners[port]
+	_, udpTaken := UDPListeners[port]
+	if tcpTaken || udpTaken {
+		return fmt.Errorf("port %d is already in use", port)
 	}
-	Listeners[port] = ln
-	log.Printf("[Core] Listening on public port %d for client %s -> %s:%d", port, clientID, targetIP, targetPort)
+	return nil
+}
 
-	go func() {
-		for {
-			userConn, err := ln.Accept()
-			if err != nil {
-				return
+// SyncServices applies a service list sent by the client and returns the merged result.
+// Public ports already assigned to a service ID (restored from the store or
+// allocated earlier) always win, so both sides agree on RemotePort.
+// With restore set, stored services the client doesn't know about are kept.
+func SyncServices(clientID string, services []common.TargetService, restore bool) []common.TargetService {
+	ClientsLock.RLock()
+	client, exists := Clients[clientID]
+	if !exists {
+		ClientsLock.RUnlock()
+		return nil
+	}
+	current := make(map[string]common.TargetService)
+	for _, s := range client.Services {
+		current[s.ID] = s
+	}
+	var kept []common.TargetService
+	if restore {
+		incoming := make(map[string]bool)
+		for _, s := range services {
+			incoming[s.ID] = true
+		}
+		for _, s := range client.Services {
+			if !incoming[s.ID] {
+				kept = append(kept, s)
 			}
-			go handleUserConnection(userConn, port, clientID, targetIP, targetPort)
 		}
-	}()
+	}
+	ClientsLock.RUnlock()
+
+	merged := make([]common.TargetService, 0, len(services)+len(kept))
+	for _, svc := range services {
+		if old, ok := current[svc.ID]; ok && old.RemotePort != 0 {
+			svc.RemotePort = old.RemotePort
+		}
+		merged = append(merged, svc)
+	}
+	merged = append(merged, kept...)
+
+	UpdateServices(clientID, merged)
+
+	ClientsLock.RLock()
+	defer ClientsLock.RUnlock()
+	return append([]common.TargetService{}, client.Services...)
 }
 
-func handleUserConnection(userConn net.Conn, publicPort int, clientID string, targetIP string, targetPort int) {
+// PushServices sends the client its current service list as a PushConfig notification
+func PushServices(clientID string) error {
 	ClientsLock.RLock()
 	client, exists := Clients[clientID]
+	if !exists {
+		ClientsLock.RUnlock()
+		return fmt.Errorf("client %s not found", clientID)
+	}
+	peer := client.Peer
+	args := &common.PushConfigArgs{
+		Services: append([]common.TargetService{}, client.Services...),
+	}
 	ClientsLock.RUnlock()
 
-	if !exists {
-		userConn.Close()
-		return
+	if peer == nil {
+		return fmt.Errorf("client %s rpc not ready", clientID)
 	}
+	return peer.Notify(common.MethodPushConfig, args)
+}
 
-	// 1. Open Data Stream to Client
-	stream, err := client.Session.Open()
+// SetUnapproved records which services wait for approval on the client
+func SetUnapproved(clientID string, ids []string) {
+	ClientsLock.Lock()
+	client, exists := Clients[clientID]
+	changed := exists && !slices.Equal(client.Unapproved, ids)
+	if changed {
+		client.Unapproved = ids
+	}
+	ClientsLock.Unlock()
+
+	if changed {
+		emitClient(EventClientUpdated, client)
+	}
+}
+
+// AllocatePort finds an available port starting from config
+func AllocatePort() (int, error) {
+	return allocatePort(nil)
+}
+
+// allocatePort is AllocatePort skipping ports already handed out but not listening yet
+func allocatePort(skip map[int]bool) (int, error) {
+	ListenerLock.Lock()
+	defer ListenerLock.Unlock()
+
+	start := config.GlobalConfig.Server.PortStart
+	if start <= 0 {
+		start = 10000
+	}
+
+	// Ports stored for offline clients stay reserved so their bookmarks keep working
+	reserved := store.ReservedPorts()
+
+	for port := start; port < 65535; port++ {
+		if _, taken := reserved[port]; taken || skip[port] {
+			continue
+		}
+		_, tcpTaken := Listeners[port]
+		_, udpTaken := UDPListeners[port]
+		if !tcpTaken && !udpTaken && portFree(port) {
+			return port, nil
+		}
+	}
+	metrics.PortAllocationFailures.Inc()
+	return 0, fmt.Errorf("no available ports")
+}
+
+// portFree double checks a port is actually bindable for both TCP and UDP,
+// so the service can later switch protocol without a new port
+func portFree(port int) bool {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		log.Printf("[Core] Failed to open stream to client %s: %v", clientID, err)
+		return false
+	}
+	ln.Close()
+	pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	pc.Close()
+	return true
+}
+
+// handleUserConnection serves a visitor of a service port. The service is
+// resolved now, from the session owning the port, so edits made since the
+// listener started apply to this visitor.
+func handleUserConnection(userConn net.Conn, publicPort int, clientID, serviceID string) {
+	svc, ok := currentService(clientID, serviceID)
+	if !ok || svc.RemotePort != publicPort || svc.Proto() != common.ProtocolTCP {
+		log.Printf("[Core] Port %d: client %s no longer has TCP service %s here, dropping visitor", publicPort, clientID, serviceID)
 		userConn.Close()
 		return
 	}
 
-	// 2. Send Handshake (Target IP:Port)
-	// Format: "IP:Port\n"
-	targetAddr := fmt.Sprintf("%s:%d\n", targetIP, targetPort)
-	_, err = stream.Write([]byte(targetAddr))
+	// 1. Open Data Stream and wait until the client has dialed the target
+	stream, err := DialService(clientID, svc, userConn)
 	if err != nil {
-		log.Printf("[Core] Failed to send handshake: %v", err)
-		stream.Close()
+		log.Printf("[Core] Port %d: data stream to client %s failed: %v", publicPort, clientID, err)
 		userConn.Close()
 		return
 	}
 
-	// 3. Pipe data
+	// 2. Pipe data
 	go func() {
 		io.Copy(userConn, stream)
 		userConn.Close()
@@ -289,3 +563,83 @@ func handleUserConnection(userConn net.Conn, publicPort int, clientID string, ta
 		stream.Close()
 	}()
 }
+
+// currentService returns the service as it is configured now
+func currentService(clientID, serviceID string) (common.TargetService, bool) {
+	ClientsLock.RLock()
+	defer ClientsLock.RUnlock()
+	if client, exists := Clients[clientID]; exists {
+		for _, s := range client.Services {
+			if s.ID == serviceID {
+				return s, true
+			}
+		}
+	}
+	return common.TargetService{}, false
+}
+
+// openDataStream opens a stream to the client, sends the handshake frame and
+// waits for the client's status. The stream is only returned once the client
+// reports the target as connected; failures are recorded on the session.
+// visitor is the public peer address shown in the connection table.
+func openDataStream(client *ClientSession, hs common.StreamHandshake, visitor string) (net.Conn, error) {
+	stream, err := client.Session.Open()
+	if err != nil {
+		recordOpenFailure(client.Identity, hs.ServiceID, "session")
+		return nil, fmt.Errorf("open stream: %v", err)
+	}
+
+	stream.SetDeadline(time.Now().Add(streamStatusTimeout))
+	if err := common.WriteFrame(stream, &hs); err != nil {
+		stream.Close()
+		recordOpenFailure(client.Identity, hs.ServiceID, "session")
+		return nil, fmt.Errorf("send handshake: %v", err)
+	}
+
+	var status common.StreamStatus
+	if err := common.ReadFrame(stream, &status); err != nil {
+		stream.Close()
+		recordOpenFailure(client.Identity, hs.ServiceID, "no reply")
+		recordStreamResult(client, hs.ServiceID, common.StatusTimeout, "no reply from client: "+err.Error())
+		return nil, &DialError{Code: common.StatusTimeout, Message: "read status: " + err.Error()}
+	}
+	stream.SetDeadline(time.Time{})
+
+	recordStreamResult(client, hs.ServiceID, status.Code, status.Message)
+	if status.Code != common.StatusOK {
+		stream.Close()
+		recordOpenFailure(client.Identity, hs.ServiceID, common.StatusText(status.Code))
+		return nil, &DialError{Code: status.Code, Message: status.Message}
+	}
+	return meterStream(stream, client, hs, visitor), nil
+}
+
+// DialError is a data stream the client answered with a non-OK status
+type DialError struct {
+	Code    uint8
+	Message string
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("client %s: %s", common.StatusText(e.Code), e.Message)
+}
+
+func recordStreamResult(client *ClientSession, serviceID string, code uint8, reason string) {
+	// Dynamic streams (SOCKS/HTTP proxy) belong to no service
+	if serviceID == "" {
+		return
+	}
+	ClientsLock.Lock()
+	_, had := client.StreamErrors[serviceID]
+	if code == common.StatusOK {
+		delete(client.StreamErrors, serviceID)
+	} else {
+		client.StreamErrors[serviceID] = StreamError{Time: time.Now(), Code: code, Reason: reason}
+	}
+	ClientsLock.Unlock()
+
+	// Only bother the Web UI when the visible state changes
+	if had || code != common.StatusOK {
+		emitClient(EventClientUpdated, client)
+	}
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"common"
+	"net"
+	"server/pkg/metrics"
+	"server/pkg/store"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dynamicService labels streams that belong to no configured service
+const dynamicService = "dynamic"
+
+func init() {
+	metrics.GaugeFunc("fffrp_clients_connected", "Connected client sessions.", nil, func() float64 {
+		ClientsLock.RLock()
+		defer ClientsLock.RUnlock()
+		return float64(len(Clients))
+	})
+	metrics.GaugeFunc("fffrp_listeners", "Open public listeners (services and proxies).", prometheus.Labels{"protocol": "tcp"}, func() float64 {
+		ListenerLock.Lock()
+		defer ListenerLock.Unlock()
+		return float64(len(Listeners))
+	})
+	metrics.GaugeFunc("fffrp_listeners", "Open public listeners (services and proxies).", prometheus.Labels{"protocol": "udp"}, func() float64 {
+		ListenerLock.Lock()
+		defer ListenerLock.Unlock()
+		return float64(len(UDPListeners))
+	})
+}
+
+// meteredConn counts payload bytes of a data stream for Prometheus and the
+// connection table, and keeps the active stream gauge in step with its lifetime
+type meteredConn struct {
+	net.Conn
+	info      Connection
+	in, out   prometheus.Counter
+	active    prometheus.Gauge
+	closeOnce sync.Once
+
+	bytesIn, bytesOut atomic.Int64
+	accounted         store.Traffic // Part of the byte counts already in pendingUsage, guarded by connsLock
+}
+
+// meterStream wraps an open data stream of a client and registers it as a connection.
+// visitor is the public peer address, if the stream serves exactly one.
+func meterStream(stream net.Conn, client *ClientSession, hs common.StreamHandshake, visitor string) net.Conn {
+	serviceID := hs.ServiceID
+	if serviceID == "" {
+		serviceID = dynamicService
+	}
+	m := &meteredConn{
+		Conn: stream,
+		info: Connection{
+			ClientID:  client.ID,
+			Identity:  client.Identity,
+			ServiceID: serviceID,
+			Protocol:  hs.Protocol,
+			Visitor:   visitor,
+			Target:    hs.Target,
+			Start:     time.Now(),
+		},
+		in:     metrics.Bytes.WithLabelValues(client.Identity, serviceID, "in"),
+		out:    metrics.Bytes.WithLabelValues(client.Identity, serviceID, "out"),
+		active: metrics.ActiveStreams.WithLabelValues(client.Identity, serviceID),
+	}
+	m.active.Inc()
+	trackConn(m)
+	return m
+}
+
+// Read is target -> visitor
+func (m *meteredConn) Read(b []byte) (int, error) {
+	n, err := m.Conn.Read(b)
+	m.out.Add(float64(n))
+	m.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// Write is visitor -> target
+func (m *meteredConn) Write(b []byte) (int, error) {
+	n, err := m.Conn.Write(b)
+	m.in.Add(float64(n))
+	m.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (m *meteredConn) Close() error {
+	m.closeOnce.Do(func() {
+		m.active.Dec()
+		untrackConn(m)
+	})
+	return m.Conn.Close()
+}
+
+func recordOpenFailure(identity, serviceID, reason string) {
+	if serviceID == "" {
+		serviceID = dynamicService
+	}
+	metrics.StreamOpenFailures.WithLabelValues(identity, serviceID, reason).Inc()
+}
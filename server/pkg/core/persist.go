@@ -0,0 +1,180 @@
+package core
+
+import (
+	"common"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"server/pkg/store"
+	"sync"
+	"time"
+)
+
+var (
+	// Records waiting to be written by identity, only the latest one counts
+	pendingLock    sync.Mutex
+	pendingRecords = make(map[string]store.ClientRecord)
+
+	// Serializes record writes, so an older record never overwrites a newer one.
+	// Lock order: ClientsLock -> persistLock.
+	persistLock sync.Mutex
+)
+
+// saveClientRecord queues the client's user info and services to be persisted
+// under its identity. Caller must hold ClientsLock, and call flushClientRecords
+// once it released it: writing the store marshals and syncs the whole file,
+// which must not stall every other client.
+func saveClientRecord(client *ClientSession) {
+	if !client.Persist {
+		return
+	}
+	// The store keeps the record and reads it under its own lock only,
+	// so it must not share the slice or map we keep changing
+	proxies := make(map[string]int, len(client.Proxies))
+	for kind, port := range client.Proxies {
+		proxies[kind] = port
+	}
+	rec := store.ClientRecord{
+		Identity:    client.Identity,
+		Name:        client.Name,
+		Phone:       client.Phone,
+		ProjectName: client.ProjectName,
+		Remark:      client.Remark,
+		Services:    append([]common.TargetService{}, client.Services...),
+		Proxies:     proxies,
+		LastSeen:    time.Now(),
+	}
+	pendingLock.Lock()
+	pendingRecords[rec.Identity] = rec
+	pendingLock.Unlock()
+}
+
+// flushClientRecords writes the records queued by saveClientRecord
+func flushClientRecords() {
+	persistLock.Lock()
+	defer persistLock.Unlock()
+
+	pendingLock.Lock()
+	records := pendingRecords
+	pendingRecords = make(map[string]store.ClientRecord)
+	pendingLock.Unlock()
+
+	for _, rec := range records {
+		if old, found := store.Default.Get(rec.Identity); found {
+			rec.SecretHash = old.SecretHash // Set by ClaimIdentity only
+		}
+		if err := store.Default.Put(rec); err != nil {
+			log.Printf("[Core] Failed to persist client %s: %v", rec.Identity, err)
+		}
+	}
+}
+
+// ForgetIdentity deletes the stored record of an offline client, releasing
+// the public ports it reserved. Its usage totals go with it.
+func ForgetIdentity(identity string) error {
+	ClientsLock.Lock()
+	defer ClientsLock.Unlock()
+	if identityOnline(identity, nil) {
+		return fmt.Errorf("client %s is online, disconnect it first", identity)
+	}
+
+	persistLock.Lock()
+	defer persistLock.Unlock()
+	pendingLock.Lock()
+	delete(pendingRecords, identity)
+	pendingLock.Unlock()
+
+	if _, found := store.Default.Get(identity); !found {
+		return fmt.Errorf("client %s not found", identity)
+	}
+	if err := store.Default.Delete(identity); err != nil {
+		return err
+	}
+	log.Printf("[Core] Forgot client %s", identity)
+	return nil
+}
+
+// ClaimIdentity checks a handshake may use identity, before it takes over the
+// identity's session, services and ports. An identity is bound to the client
+// secret it was first seen with. Identities stored before clients had secrets
+// are bound on their next handshake, as long as the project matches.
+func ClaimIdentity(identity, secret, projectName string) error {
+	ClientsLock.Lock()
+	defer ClientsLock.Unlock()
+	// A record write in flight would drop the hash
+	persistLock.Lock()
+	defer persistLock.Unlock()
+
+	hash := ""
+	if secret != "" {
+		sum := sha256.Sum256([]byte(secret))
+		hash = hex.EncodeToString(sum[:])
+	}
+
+	rec, found := store.Default.Get(identity)
+	if found && rec.SecretHash != "" {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(rec.SecretHash)) != 1 {
+			return fmt.Errorf("client secret does not match identity %s", identity)
+		}
+		return nil
+	}
+	if found && rec.ProjectName != projectName {
+		return fmt.Errorf("identity %s belongs to project %q", identity, rec.ProjectName)
+	}
+	if hash == "" {
+		return nil // Older client, nothing to bind
+	}
+
+	if !found {
+		rec = store.ClientRecord{Identity: identity, ProjectName: projectName, LastSeen: time.Now()}
+	}
+	rec.SecretHash = hash
+	if err := store.Default.Put(rec); err != nil {
+		return fmt.Errorf("persist identity %s: %v", identity, err)
+	}
+	log.Printf("[Core] Identity %s bound to its client secret", identity)
+	return nil
+}
+
+// identityOnline reports whether another live session uses identity.
+// Caller must hold ClientsLock.
+func identityOnline(identity string, except *ClientSession) bool {
+	for _, c := range Clients {
+		if c != except && c.Identity == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// startListeners (re)opens public listeners for all services of a client
+func startListeners(clientID string) {
+	ClientsLock.RLock()
+	client, exists := Clients[clientID]
+	if !exists {
+		ClientsLock.RUnlock()
+		return
+	}
+	services := make([]common.TargetService, 0, len(client.Services))
+	for _, svc := range client.Services {
+		services = append(services, svc)
+	}
+	proxies := make(map[string]int, len(client.Proxies))
+	for kind, port := range client.Proxies {
+		proxies[kind] = port
+	}
+	ClientsLock.RUnlock()
+
+	for _, svc := range services {
+		if svc.RemotePort != 0 {
+			StartPublicListener(svc.RemotePort, clientID, svc)
+		}
+	}
+	for kind, port := range proxies {
+		if _, err := StartProxy(clientID, kind, port); err != nil {
+			log.Printf("[Core] Failed to restore %s proxy on port %d: %v", kind, port, err)
+		}
+	}
+}
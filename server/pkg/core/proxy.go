@@ -0,0 +1,120 @@
+package core
+
+import (
+	"common"
+	"fmt"
+	"log"
+	"net"
+	"server/pkg/auth"
+	"time"
+)
+
+// Proxy kinds a client session can expose on its own public port
+const (
+	ProxySOCKS5 = "socks5"
+	ProxyHTTP   = "http" // CONNECT tunnels and plain forward requests
+)
+
+// proxyHandshakeTimeout bounds how long a visitor may take to send its
+// greeting/request before we give up (also the idle time between HTTP requests)
+const proxyHandshakeTimeout = 30 * time.Second
+
+// proxyHandlers serve one accepted visitor connection for a client
+var proxyHandlers = map[string]func(conn net.Conn, clientID string){
+	ProxySOCKS5: serveSOCKS5,
+	ProxyHTTP:   serveHTTPProxy,
+}
+
+// StartProxy opens a dynamic proxy of the given kind for a client.
+// Port 0 allocates a new one. The listener lives in Listeners like any
+// service port, so allocation and StopPublicListener treat it the same.
+func StartProxy(clientID, kind string, port int) (int, error) {
+	handler, ok := proxyHandlers[kind]
+	if !ok {
+		return 0, fmt.Errorf("unknown proxy kind %s", kind)
+	}
+
+	ClientsLock.RLock()
+	client, exists := Clients[clientID]
+	var current int
+	if exists {
+		current = client.Proxies[kind]
+	}
+	ClientsLock.RUnlock()
+	if !exists {
+		return 0, fmt.Errorf("client %s not found", clientID)
+	}
+	if !client.Has(common.CapDynamicStreams) {
+		return 0, fmt.Errorf("client %s does not support proxy streams, please upgrade it", clientID)
+	}
+	if port == 0 {
+		port = current
+	}
+	if port == 0 {
+		var err error
+		if port, err = AllocatePort(); err != nil {
+			return 0, err
+		}
+	} else if port != current {
+		ClientsLock.RLock()
+		err := portUsable(client, port)
+		ClientsLock.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	ListenerLock.Lock()
+	if _, exists := Listeners[port]; exists && port != current {
+		ListenerLock.Unlock()
+		return 0, fmt.Errorf("port %d already in use", port)
+	}
+	err := listenTCP(port, clientID, "", handler)
+	ListenerLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("[Core] %s proxy for client %s listening on port %d", kind, clientID, port)
+
+	// Moved to another port: the new listener is up, drop the old one
+	if current != 0 && current != port {
+		StopPublicListener(current, clientID)
+	}
+
+	ClientsLock.Lock()
+	client.Proxies[kind] = port
+	saveClientRecord(client)
+	ClientsLock.Unlock()
+	flushClientRecords()
+
+	emitClient(EventClientUpdated, client)
+	return port, nil
+}
+
+// StopProxy closes a client's dynamic proxy of the given kind
+func StopProxy(clientID, kind string) error {
+	ClientsLock.Lock()
+	client, exists := Clients[clientID]
+	if !exists {
+		ClientsLock.Unlock()
+		return fmt.Errorf("client %s not found", clientID)
+	}
+	port := client.Proxies[kind]
+	delete(client.Proxies, kind)
+	saveClientRecord(client)
+	ClientsLock.Unlock()
+	flushClientRecords()
+
+	if port != 0 {
+		StopPublicListener(port, clientID)
+	}
+	emitClient(EventClientUpdated, client)
+	return nil
+}
+
+// proxyAuth checks proxy credentials against the web admin accounts.
+// Reaching into a customer LAN is an operator action.
+func proxyAuth(username, password string) bool {
+	role, err := auth.Verify(username, password)
+	return err == nil && auth.HasRole(role, auth.RoleOperator)
+}
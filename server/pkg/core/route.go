@@ -0,0 +1,120 @@
+package core
+
+import (
+	"common"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Label turns an identity or service ID into a DNS label:
+// lowercase letters, digits and '-' only
+func Label(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	label := strings.Trim(b.String(), "-")
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label
+}
+
+// ServiceLabel is the host label of a service: its Subdomain, or the label of its ID
+func ServiceLabel(svc common.TargetService) string {
+	if svc.Subdomain != "" {
+		return Label(svc.Subdomain)
+	}
+	return Label(svc.ID)
+}
+
+// FindServiceByLabel resolves "<service>.<client>" host labels to a live session and TCP service
+func FindServiceByLabel(clientLabel, serviceLabel string) (string, common.TargetService, bool) {
+	ClientsLock.RLock()
+	defer ClientsLock.RUnlock()
+
+	for id, client := range Clients {
+		if Label(client.Identity) != clientLabel {
+			continue
+		}
+		for _, svc := range client.Services {
+			if svc.Proto() == common.ProtocolTCP && ServiceLabel(svc) == serviceLabel {
+				return id, svc, true
+			}
+		}
+	}
+	return "", common.TargetService{}, false
+}
+
+// DialService opens a data stream to a client's TCP service.
+// The returned conn is ready for payload: the client has already connected the target.
+// visitor is the public connection the stream serves, used for the PROXY protocol
+// header; nil when the stream is not tied to one visitor.
+func DialService(clientID string, svc common.TargetService, visitor net.Conn) (net.Conn, error) {
+	ClientsLock.RLock()
+	client, exists := Clients[clientID]
+	ClientsLock.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("client %s not connected", clientID)
+	}
+
+	hs := common.StreamHandshake{
+		ServiceID: svc.ID,
+		Target:    net.JoinHostPort(svc.LocalIP, strconv.Itoa(svc.LocalPort)),
+		Protocol:  common.ProtocolTCP,
+	}
+	if svc.ProxyProtocol != 0 {
+		if !client.Has(common.CapProxyProtocol) {
+			// Without the header the target would see a non-PROXY stream it rejects anyway
+			return nil, &DialError{Code: common.StatusUnsupported, Message: "client does not support PROXY protocol"}
+		}
+		hs.ProxyProtocol = uint8(svc.ProxyProtocol)
+	}
+	visitorAddr := ""
+	if visitor != nil {
+		visitorAddr = visitor.RemoteAddr().String()
+	}
+	if hs.ProxyProtocol != 0 && visitor != nil {
+		hs.SourceAddr = visitorAddr
+		hs.DestAddr = visitor.LocalAddr().String()
+	}
+	return openDataStream(client, hs, visitorAddr)
+}
+
+// DialTarget opens a dynamic data stream to an arbitrary "host:port" in the client's network.
+// The client resolves the host and checks it against its own allowlist.
+// visitor is the proxy connection the stream serves.
+func DialTarget(clientID, target string, visitor net.Conn) (net.Conn, error) {
+	ClientsLock.RLock()
+	client, exists := Clients[clientID]
+	ClientsLock.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("client %s not connected", clientID)
+	}
+	if !client.Has(common.CapDynamicStreams) {
+		return nil, &DialError{Code: common.StatusUnsupported, Message: "client does not support proxy streams"}
+	}
+
+	return openDataStream(client, common.StreamHandshake{
+		Target:   target,
+		Protocol: common.ProtocolTCP,
+		Flags:    common.FlagDynamic,
+	}, visitor.RemoteAddr().String())
+}
+
+// clientWithout returns the session if it is connected but lacks capability
+func clientWithout(clientID, capability string) (*ClientSession, bool) {
+	ClientsLock.RLock()
+	defer ClientsLock.RUnlock()
+	client, exists := Clients[clientID]
+	if !exists || client.Has(capability) {
+		return nil, false
+	}
+	return client, true
+}
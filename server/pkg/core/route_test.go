@@ -0,0 +1,70 @@
+package core
+
+import (
+	"common"
+	"testing"
+)
+
+func TestLabel(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"box1", "box1"},
+		{"Box_1", "box-1"},
+		{"3f2a-UUID-like", "3f2a-uuid-like"},
+		{"--edge--", "edge"},
+		{"svc-10001", "svc-10001"},
+		{"中文", ""},
+	}
+	for _, tt := range tests {
+		if got := Label(tt.in); got != tt.want {
+			t.Errorf("Label(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	long := ""
+	for i := 0; i < 70; i++ {
+		long += "a"
+	}
+	if got := Label(long); len(got) != 63 {
+		t.Errorf("Label of 70 letters has length %d, want 63", len(got))
+	}
+}
+
+func TestFindServiceByLabel(t *testing.T) {
+	ClientsLock.Lock()
+	saved := Clients
+	Clients = map[string]*ClientSession{
+		"Box_1": {Identity: "Box_1", Services: []common.TargetService{
+			{ID: "svc-10001", LocalIP: "10.0.0.1", LocalPort: 80},
+			{ID: "svc-10002", LocalIP: "10.0.0.1", LocalPort: 443, Subdomain: "Admin"},
+			{ID: "svc-10003", LocalIP: "10.0.0.1", LocalPort: 53, Protocol: common.ProtocolUDP},
+		}},
+	}
+	ClientsLock.Unlock()
+	defer func() {
+		ClientsLock.Lock()
+		Clients = saved
+		ClientsLock.Unlock()
+	}()
+
+	tests := []struct {
+		client, service string
+		wantID          string // Empty: no route
+	}{
+		{"box-1", "svc-10001", "svc-10001"},
+		{"box-1", "admin", "svc-10002"},
+		{"box-1", "svc-10002", ""}, // A subdomain replaces the ID label
+		{"box-1", "svc-10003", ""}, // UDP is not routable by host
+		{"box-2", "svc-10001", ""},
+	}
+	for _, tt := range tests {
+		id, svc, ok := FindServiceByLabel(tt.client, tt.service)
+		if tt.wantID == "" {
+			if ok {
+				t.Errorf("%s.%s routed to %s", tt.service, tt.client, svc.ID)
+			}
+			continue
+		}
+		if !ok || id != "Box_1" || svc.ID != tt.wantID {
+			t.Errorf("%s.%s = %q, %q, %v, want Box_1, %q", tt.service, tt.client, id, svc.ID, ok, tt.wantID)
+		}
+	}
+}
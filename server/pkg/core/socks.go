@@ -0,0 +1,188 @@
+package core
+
+import (
+	"common"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 constants (RFC 1928 / RFC 1929)
+const (
+	socksVersion      = 0x05
+	socksAuthVersion  = 0x01
+	socksMethodUser   = 0x02
+	socksMethodNone   = 0xFF
+	socksCmdConnect   = 0x01
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+	socksRepSuccess   = 0x00
+	socksRepFailure   = 0x01
+	socksRepNotAllow  = 0x02
+	socksRepHostUnrch = 0x04
+	socksRepRefused   = 0x05
+	socksRepCmdUnsup  = 0x07
+	socksRepAtypUnsup = 0x08
+)
+
+// serveSOCKS5 handles one SOCKS5 visitor. Each CONNECT becomes a dynamic
+// data stream: the client dials the requested host inside the LAN, subject
+// to its own allowlist.
+func serveSOCKS5(conn net.Conn, clientID string) {
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+
+	target, err := socksHandshake(conn)
+	if err != nil {
+		log.Printf("[SOCKS] %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	stream, err := DialTarget(clientID, target, conn)
+	if err != nil {
+		log.Printf("[SOCKS] %s -> %s via client %s failed: %v", conn.RemoteAddr(), target, clientID, err)
+		socksReply(conn, socksRepForError(err))
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, socksRepSuccess); err != nil {
+		stream.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	go func() {
+		io.Copy(conn, stream)
+		conn.Close()
+	}()
+	go func() {
+		io.Copy(stream, conn)
+		stream.Close()
+	}()
+}
+
+// socksHandshake runs method negotiation, username/password auth and
+// reads the CONNECT request. Returns the requested "host:port".
+func socksHandshake(conn net.Conn) (string, error) {
+	// 1. Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", errors.New("not a SOCKS5 request")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	hasUser := false
+	for _, m := range methods {
+		if m == socksMethodUser {
+			hasUser = true
+		}
+	}
+	if !hasUser {
+		conn.Write([]byte{socksVersion, socksMethodNone})
+		return "", errors.New("client does not offer username/password auth")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksMethodUser}); err != nil {
+		return "", err
+	}
+
+	// 2. Auth: VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksAuthVersion {
+		return "", errors.New("bad auth version")
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", err
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return "", err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return "", err
+	}
+	if !proxyAuth(string(user), string(pass)) {
+		conn.Write([]byte{socksAuthVersion, 0x01})
+		return "", errors.New("authentication failed for user " + string(user))
+	}
+	if _, err := conn.Write([]byte{socksAuthVersion, 0x00}); err != nil {
+		return "", err
+	}
+
+	// 3. Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	if req[1] != socksCmdConnect {
+		socksReply(conn, socksRepCmdUnsup)
+		return "", errors.New("only CONNECT is supported")
+	}
+
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if req[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		if _, err := io.ReadFull(conn, plen); err != nil {
+			return "", err
+		}
+		name := make([]byte, plen[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksRepAtypUnsup)
+		return "", errors.New("unsupported address type")
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socksReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socksVersion, rep, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func socksRepForError(err error) byte {
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) {
+		return socksRepFailure
+	}
+	switch dialErr.Code {
+	case common.StatusRefused:
+		return socksRepNotAllow
+	case common.StatusTimeout:
+		return socksRepHostUnrch
+	case common.StatusDialFailed:
+		return socksRepRefused
+	}
+	return socksRepFailure
+}
@@ -0,0 +1,232 @@
+package core
+
+import (
+	"common"
+	"fmt"
+	"log"
+	"net"
+	"server/config"
+	"sync"
+	"time"
+)
+
+// udpQueueSize is how many datagrams we buffer per peer while its stream opens
+const udpQueueSize = 64
+
+// udpListener relays a public UDP port to a client.
+// Every remote peer address gets its own data stream (an association),
+// closed again after the idle timeout.
+type udpListener struct {
+	conn net.PacketConn
+	port int
+
+	// Owner, guarded by ListenerLock. Read for every new association,
+	// so the session can re-point the port like a publicListener.
+	clientID  string
+	serviceID string
+
+	lock   sync.Mutex
+	assocs map[string]*udpAssoc // Peer Addr -> Association
+	closed chan struct{}
+}
+
+type udpAssoc struct {
+	peer       net.Addr
+	out        chan []byte // Datagrams waiting to be written to the stream
+	lastActive time.Time   // Guarded by udpListener.lock
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func (a *udpAssoc) close() {
+	a.closeOnce.Do(func() { close(a.done) })
+}
+
+func udpIdleTimeout() time.Duration {
+	seconds := config.GlobalConfig.Server.UDPIdleTimeoutSeconds
+	if seconds <= 0 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func startUDPListener(port int, clientID string, svc common.TargetService) error {
+	ListenerLock.Lock()
+	defer ListenerLock.Unlock()
+
+	if ul, exists := UDPListeners[port]; exists {
+		if ul.clientID != clientID {
+			log.Printf("[Core] UDP port %d belongs to client %s, refusing it to client %s", port, ul.clientID, clientID)
+			return fmt.Errorf("UDP port %d belongs to another client", port)
+		}
+		if ul.serviceID != svc.ID {
+			log.Printf("[Core] UDP port %d of client %s reassigned from %s to %s", port, clientID, ul.serviceID, svc.ID)
+		}
+		ul.serviceID = svc.ID
+		return nil
+	}
+
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Printf("[Core] Failed to listen on UDP port %d: %v", port, err)
+		return err
+	}
+
+	ul := &udpListener{
+		conn:      conn,
+		port:      port,
+		clientID:  clientID,
+		serviceID: svc.ID,
+		assocs:    make(map[string]*udpAssoc),
+		closed:    make(chan struct{}),
+	}
+	UDPListeners[port] = ul
+	log.Printf("[Core] Listening on public UDP port %d for client %s -> %s:%d", port, clientID, svc.LocalIP, svc.LocalPort)
+
+	go ul.readLoop()
+	go ul.reapLoop()
+	return nil
+}
+
+// Close stops the listener and all its associations
+func (ul *udpListener) Close() {
+	ul.conn.Close()
+
+	ul.lock.Lock()
+	defer ul.lock.Unlock()
+	select {
+	case <-ul.closed:
+	default:
+		close(ul.closed)
+	}
+	for key, a := range ul.assocs {
+		a.close()
+		delete(ul.assocs, key)
+	}
+}
+
+func (ul *udpListener) readLoop() {
+	buf := make([]byte, common.MaxDatagram)
+	for {
+		n, peer, err := ul.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		payload := append([]byte(nil), buf[:n]...)
+
+		ul.lock.Lock()
+		a, exists := ul.assocs[peer.String()]
+		if !exists {
+			a = &udpAssoc{
+				peer: peer,
+				out:  make(chan []byte, udpQueueSize),
+				done: make(chan struct{}),
+			}
+			ul.assocs[peer.String()] = a
+			go ul.serve(a)
+		}
+		a.lastActive = time.Now()
+		ul.lock.Unlock()
+
+		// Never block the shared socket on one slow peer: drop instead, like UDP would
+		select {
+		case a.out <- payload:
+		default:
+		}
+	}
+}
+
+// serve opens the data stream for one peer and pumps datagrams both ways
+func (ul *udpListener) serve(a *udpAssoc) {
+	defer func() {
+		a.close()
+		ul.lock.Lock()
+		if ul.assocs[a.peer.String()] == a {
+			delete(ul.assocs, a.peer.String())
+		}
+		ul.lock.Unlock()
+	}()
+
+	// Resolve the owner's service now: new associations follow edits and
+	// reassignments, open ones keep their stream
+	ListenerLock.Lock()
+	clientID, serviceID := ul.clientID, ul.serviceID
+	ListenerLock.Unlock()
+	svc, ok := currentService(clientID, serviceID)
+	if !ok || svc.RemotePort != ul.port || svc.Proto() != common.ProtocolUDP {
+		log.Printf("[Core] UDP port %d: client %s no longer has UDP service %s here, dropping %s", ul.port, clientID, serviceID, a.peer)
+		return
+	}
+
+	ClientsLock.RLock()
+	client, exists := Clients[clientID]
+	ClientsLock.RUnlock()
+	if !exists {
+		return
+	}
+
+	stream, err := openDataStream(client, common.StreamHandshake{
+		ServiceID: svc.ID,
+		Target:    net.JoinHostPort(svc.LocalIP, fmt.Sprint(svc.LocalPort)),
+		Protocol:  common.ProtocolUDP,
+	}, a.peer.String())
+	if err != nil {
+		log.Printf("[Core] UDP port %d: data stream for %s failed: %v", ul.port, a.peer, err)
+		return
+	}
+	defer stream.Close()
+
+	// Client -> Peer
+	go func() {
+		defer a.close()
+		buf := make([]byte, common.MaxDatagram)
+		for {
+			payload, err := common.ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			ul.lock.Lock()
+			a.lastActive = time.Now()
+			ul.lock.Unlock()
+			if _, err := ul.conn.WriteTo(payload, a.peer); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Peer -> Client
+	for {
+		select {
+		case <-a.done:
+			return
+		case payload := <-a.out:
+			if err := common.WriteDatagram(stream, payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// reapLoop closes associations that saw no traffic for the idle timeout
+func (ul *udpListener) reapLoop() {
+	timeout := udpIdleTimeout()
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ul.closed:
+			return
+		case <-ticker.C:
+		}
+
+		ul.lock.Lock()
+		for key, a := range ul.assocs {
+			if time.Since(a.lastActive) > timeout {
+				a.close()
+				delete(ul.assocs, key)
+			}
+		}
+		ul.lock.Unlock()
+	}
+}
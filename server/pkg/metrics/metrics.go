@@ -0,0 +1,64 @@
+// Package metrics holds the server's Prometheus collectors, served on /metrics.
+// Labels use the stable client identity (not the session ID) and the service ID,
+// so series survive reconnects.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every fffrp collector plus the Go runtime and process ones
+var Registry = prometheus.NewRegistry()
+
+var (
+	ActiveStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fffrp_active_streams",
+		Help: "Open data streams per client and service (service \"dynamic\" for SOCKS5/HTTP proxy streams).",
+	}, []string{"client", "service"})
+
+	Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fffrp_bytes_total",
+		Help: "Payload bytes through data streams. direction=in is visitor to target, out is target to visitor.",
+	}, []string{"client", "service", "direction"})
+
+	StreamOpenFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fffrp_stream_open_failures_total",
+		Help: "Data streams that could not be opened, by reason (client status or transport error).",
+	}, []string{"client", "service", "reason"})
+
+	HandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fffrp_handshake_failures_total",
+		Help: "Rejected client connections by reason (tls, version, auth).",
+	}, []string{"reason"})
+
+	PortAllocationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fffrp_port_allocation_failures_total",
+		Help: "Public port allocations that found no free port.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ActiveStreams, Bytes, StreamOpenFailures, HandshakeFailures, PortAllocationFailures,
+	)
+}
+
+// GaugeFunc registers a gauge whose value is computed at scrape time
+func GaugeFunc(name, help string, labels prometheus.Labels, fn func() float64) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	}, fn))
+}
+
+// Handler serves the registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -2,12 +2,19 @@ package rpc
 
 import (
 	"common"
+	"common/jsonrpc"
+	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"log"
 	"net"
-	"net/rpc"
+	"server/config"
+	"server/pkg/auth"
 	"server/pkg/core"
+	"server/pkg/metrics"
+	"server/pkg/update"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/yamux"
@@ -15,54 +22,225 @@ import (
 
 // ServerRPCContext holds context for a specific client connection
 type ServerRPCContext struct {
-	Session   *yamux.Session
-	RPCClient *rpc.Client
-	Conn      net.Conn
-	ClientID  string // Stored after handshake
+	Session *yamux.Session
+	Peer    *jsonrpc.Peer // Control stream, carries calls in both directions
+	Conn    net.Conn
+
+	// Session ID, set once the handshake registered the client. Calls run
+	// concurrently, so a pipelined call may race the handshake.
+	clientID    string
+	handshaking bool // A Handshake call is running, guarded by lock
+	failed      bool // Authentication failed, nothing else is accepted until the session closes
+	lock        sync.Mutex
+}
+
+// ClientID returns the session ID, "" until the handshake has completed
+func (r *ServerRPCContext) ClientID() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.clientID
+}
+
+// Register serves the client's control calls on the peer
+func (r *ServerRPCContext) Register() {
+	jsonrpc.Handle(r.Peer, common.MethodHandshake, r.Handshake)
+	jsonrpc.Handle(r.Peer, common.MethodSyncConfig, r.SyncConfig)
+	jsonrpc.Handle(r.Peer, common.MethodHeartbeat, r.Heartbeat)
+	jsonrpc.Handle(r.Peer, common.MethodUpdateChunk, r.UpdateChunk)
+}
+
+var (
+	errNotAuthenticated = errors.New("not authenticated")
+	errHandshakeDone    = errors.New("handshake already done on this session")
+	errTooManyFailures  = errors.New("too many failed handshakes, try again later")
+)
+
+// Failed handshakes allowed per remote host before it is locked out for a while
+const (
+	maxHandshakeFailures   = 10
+	handshakeFailureWindow = 10 * time.Minute
+)
+
+var handshakeLimiter = auth.NewLimiter(maxHandshakeFailures, handshakeFailureWindow)
+
+// rejectHandshake fails the session: no further call is served, and it is
+// closed once the error reply had a moment to reach the client
+func (r *ServerRPCContext) rejectHandshake(err error) error {
+	log.Printf("[RPC] Handshake from %s rejected: %v", r.Conn.RemoteAddr(), err)
+	metrics.HandshakeFailures.WithLabelValues("auth").Inc()
+	handshakeLimiter.Fail(r.Conn.RemoteAddr().String())
+
+	r.lock.Lock()
+	r.failed = true
+	r.lock.Unlock()
+	time.AfterFunc(time.Second, func() { r.Session.Close() })
+	return err
+}
+
+// authenticate checks the handshake token against the global secret
+// and the per-project token list
+func authenticate(args *common.HandshakeArgs) error {
+	cfg := config.GlobalConfig.Auth
+	if cfg.Token == "" && len(cfg.ProjectTokens) == 0 {
+		log.Println("[RPC] WARNING: no auth token configured, accepting client without authentication")
+		return nil
+	}
+	if args.Token == "" {
+		return errors.New("auth token required")
+	}
+
+	if cfg.Token != "" && tokenEqual(args.Token, cfg.Token) {
+		return nil
+	}
+	for _, t := range cfg.ProjectTokens[args.ProjectName] {
+		if tokenEqual(args.Token, t) {
+			return nil
+		}
+	}
+	return errors.New("invalid auth token")
+}
+
+func tokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
 
-type ServerRPC struct{} // Deprecated
+func (r *ServerRPCContext) Handshake(ctx context.Context, args *common.HandshakeArgs) (*common.HandshakeReply, error) {
+	// One handshake per session: a second one would take over or duplicate
+	// the client already registered on it
+	r.lock.Lock()
+	if r.failed {
+		r.lock.Unlock()
+		return nil, errNotAuthenticated
+	}
+	if r.clientID != "" || r.handshaking {
+		r.lock.Unlock()
+		return nil, errHandshakeDone
+	}
+	r.handshaking = true
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		r.handshaking = false
+		r.lock.Unlock()
+	}()
 
-func (r *ServerRPCContext) Handshake(args *common.HandshakeArgs, reply *common.BaseReply) error {
 	log.Printf("[RPC] Handshake from %s (v%s) | User: %s, Phone: %s, Project: %s, Remark: %s",
 		args.ClientID, args.Version, args.Name, args.Phone, args.ProjectName, args.Remark)
-	if args.Version != common.Version {
-		return errors.New("version mismatch")
+	// Same major version and not below the minimum: older clients only get a warning
+	if err := common.CheckCompatible(args.Version); err != nil {
+		metrics.HandshakeFailures.WithLabelValues("version").Inc()
+		return nil, fmt.Errorf("%v, please upgrade the client", err)
+	}
+
+	// Enable only what both sides support
+	clientCaps := args.Capabilities
+	if clientCaps == nil {
+		clientCaps = common.BaselineCapabilities
+	}
+	caps := common.IntersectCapabilities(common.LocalCapabilities, clientCaps)
+	// Every data stream starts with a frame, a client without them could never forward
+	if !common.HasCapability(caps, common.CapStreamHandshake) {
+		metrics.HandshakeFailures.WithLabelValues("version").Inc()
+		return nil, fmt.Errorf("client %s does not speak data stream frame version %d, please upgrade the client", args.Version, common.StreamFrameVersion)
+	}
+
+	if !handshakeLimiter.Allowed(r.Conn.RemoteAddr().String()) {
+		return nil, r.rejectHandshake(errTooManyFailures)
+	}
+	if err := authenticate(args); err != nil {
+		return nil, r.rejectHandshake(err)
 	}
 
 	// Register the client in Core
-	// Use a completely unique ID for every connection to allow duplicates
-	// Format: <ClientID>@<IP>:<Port>-<Timestamp>
-	remoteAddr := r.Conn.RemoteAddr().String()
-	timestamp := time.Now().UnixNano()
-	finalID := fmt.Sprintf("%s@%s-%d", args.ClientID, remoteAddr, timestamp)
+	// The client identity is the primary key: a reconnect with the same identity
+	// takes over the old session. Clients older than persistent IDs send nothing,
+	// so fall back to their user info.
+	identity := args.ClientID
+	if identity == "" {
+		identity = fmt.Sprintf("legacy:%s:%s:%s", args.ProjectName, args.Name, args.Phone)
+	}
+
+	// Only the installation that owns the identity may take over its session and ports
+	if err := core.ClaimIdentity(identity, args.ClientSecret, args.ProjectName); err != nil {
+		return nil, r.rejectHandshake(err)
+	}
+	handshakeLimiter.Succeed(r.Conn.RemoteAddr().String())
+
+	finalID := identity
+	if config.GlobalConfig.Server.AllowDuplicateSessions {
+		// Opt-in: unique ID for every connection to allow duplicates
+		// Format: <Identity>@<IP>:<Port>-<Timestamp>
+		remoteAddr := r.Conn.RemoteAddr().String()
+		timestamp := time.Now().UnixNano()
+		finalID = fmt.Sprintf("%s@%s-%d", identity, remoteAddr, timestamp)
+	}
+
+	log.Printf("[RPC] Registering client as: %s (identity %s)", finalID, identity)
 
-	log.Printf("[RPC] Registering client as: %s", finalID)
-	r.ClientID = finalID // Store for later use
+	core.AddClient(finalID, identity, r.Session, r.Peer, args.Name, args.Phone, args.ProjectName, args.Remark, args.Version, caps)
 
-	core.AddClient(finalID, r.Session, r.RPCClient, args.Name, args.Phone, args.ProjectName, args.Remark)
+	// Only now other calls may use the session
+	r.lock.Lock()
+	r.clientID = finalID
+	r.lock.Unlock()
 
-	reply.Success = true
-	reply.Message = "Welcome"
-	return nil
+	reply := &common.HandshakeReply{
+		Success:       true,
+		Message:       "Welcome",
+		ServerVersion: common.Version,
+		Capabilities:  caps,
+	}
+	if common.CompareVersions(args.Version, common.Version) < 0 {
+		reply.UpgradeRecommended = true
+		reply.Message = fmt.Sprintf("Welcome. Client %s is older than server %s, please upgrade", args.Version, common.Version)
+	}
+	if common.HasCapability(caps, common.CapAutoUpdate) {
+		if info, ok := update.Latest(args.OS, args.Arch); ok && common.CompareVersions(info.Version, args.Version) > 0 {
+			reply.Update = info
+			reply.UpgradeRecommended = true
+		}
+	}
+	return reply, nil
 }
 
-func (r *ServerRPCContext) SyncConfig(args *common.SyncConfigArgs, reply *common.BaseReply) error {
+func (r *ServerRPCContext) SyncConfig(ctx context.Context, args *common.SyncConfigArgs) (*common.BaseReply, error) {
 	// Use the ID we stored, ignore what client sent (because we modified it)
-	targetID := r.ClientID
+	targetID := r.ClientID()
 	if targetID == "" {
-		// Fallback if Handshake wasn't called (should not happen)
-		targetID = args.ClientID
+		return nil, errNotAuthenticated
+	}
+
+	log.Printf("[RPC] SyncConfig from %s (mapped from %s): %d services, restore=%v", targetID, args.ClientID, len(args.Services), args.Restore)
+	core.SyncServices(targetID, args.Services, args.Restore)
+	core.SetUnapproved(targetID, args.Unapproved)
+
+	// Push the merged list back so the client learns assigned/restored ports.
+	// A notification, the client does not need to answer it.
+	if err := core.PushServices(targetID); err != nil {
+		log.Printf("[RPC] Push after SyncConfig to %s failed: %v", targetID, err)
 	}
 
-	log.Printf("[RPC] SyncConfig from %s (mapped from %s): %d services", targetID, args.ClientID, len(args.Services))
-	core.UpdateServices(targetID, args.Services)
-	reply.Success = true
-	return nil
+	return &common.BaseReply{Success: true}, nil
 }
 
-func (r *ServerRPCContext) Heartbeat(args *common.BaseArgs, reply *common.BaseReply) error {
+func (r *ServerRPCContext) Heartbeat(ctx context.Context, args *common.HeartbeatArgs) (*common.BaseReply, error) {
+	clientID := r.ClientID()
+	if clientID == "" {
+		return nil, errNotAuthenticated
+	}
 	// log.Printf("[RPC] Heartbeat from %s", args.ClientID) // verbose
-	reply.Success = true
-	return nil
+	core.Touch(clientID, args.LastRTTMs, args.MissedBeats)
+	return &common.BaseReply{Success: true}, nil
+}
+
+// UpdateChunk streams a hosted client build to an authenticated client
+func (r *ServerRPCContext) UpdateChunk(ctx context.Context, args *common.UpdateChunkArgs) (*common.UpdateChunkReply, error) {
+	clientID := r.ClientID()
+	if clientID == "" {
+		return nil, errNotAuthenticated
+	}
+	if args.Offset == 0 {
+		log.Printf("[RPC] Client %s downloading update %s (%s/%s)", clientID, args.Version, args.OS, args.Arch)
+	}
+	return update.ReadChunk(args)
 }
@@ -0,0 +1,181 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps records in memory only
+type MemoryStore struct {
+	lock    sync.RWMutex
+	records map[string]ClientRecord
+	usage   map[string]map[string]Usage // Identity -> Service ID -> Usage
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: make(map[string]ClientRecord),
+		usage:   make(map[string]map[string]Usage),
+	}
+}
+
+func (m *MemoryStore) Get(identity string) (ClientRecord, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	rec, ok := m.records[identity]
+	return rec, ok
+}
+
+func (m *MemoryStore) Put(rec ClientRecord) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.records[rec.Identity] = rec
+	return nil
+}
+
+func (m *MemoryStore) Delete(identity string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.records, identity)
+	delete(m.usage, identity)
+	return nil
+}
+
+func (m *MemoryStore) List() []ClientRecord {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	list := make([]ClientRecord, 0, len(m.records))
+	for _, rec := range m.records {
+		list = append(list, rec)
+	}
+	return list
+}
+
+func (m *MemoryStore) AddUsage(deltas []UsageDelta) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cutoff := time.Now().Add(-UsageDailyRetention).Format("2006-01-02")
+	for _, d := range deltas {
+		services := m.usage[d.Identity]
+		if services == nil {
+			services = make(map[string]Usage)
+			m.usage[d.Identity] = services
+		}
+		u := services[d.ServiceID]
+		if u.Daily == nil {
+			u.Daily = make(map[string]Traffic)
+		}
+		if u.Monthly == nil {
+			u.Monthly = make(map[string]Traffic)
+		}
+		day, month := d.Time.Format("2006-01-02"), d.Time.Format("2006-01")
+		u.Daily[day] = addTraffic(u.Daily[day], d.Traffic)
+		u.Monthly[month] = addTraffic(u.Monthly[month], d.Traffic)
+		for day := range u.Daily {
+			if day < cutoff {
+				delete(u.Daily, day)
+			}
+		}
+		services[d.ServiceID] = u
+	}
+	return nil
+}
+
+func addTraffic(a, b Traffic) Traffic {
+	return Traffic{In: a.In + b.In, Out: a.Out + b.Out}
+}
+
+func (m *MemoryStore) Usage(identity string) map[string]Usage {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	usage := make(map[string]Usage)
+	for id, u := range m.usage[identity] {
+		c := Usage{Daily: make(map[string]Traffic), Monthly: make(map[string]Traffic)}
+		for k, v := range u.Daily {
+			c.Daily[k] = v
+		}
+		for k, v := range u.Monthly {
+			c.Monthly[k] = v
+		}
+		usage[id] = c
+	}
+	return usage
+}
+
+// JSONStore is a MemoryStore that rewrites a JSON file on every change
+type JSONStore struct {
+	*MemoryStore
+	path      string
+	writeLock sync.Mutex
+}
+
+// jsonFile is the on-disk layout
+type jsonFile struct {
+	Clients map[string]ClientRecord     `json:"clients"`
+	Usage   map[string]map[string]Usage `json:"usage,omitempty"`
+}
+
+func OpenJSONStore(path string) (*JSONStore, error) {
+	s := &JSONStore{MemoryStore: NewMemoryStore(), path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file jsonFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for id, rec := range file.Clients {
+		s.records[id] = rec
+	}
+	for id, services := range file.Usage {
+		s.usage[id] = services
+	}
+	return s, nil
+}
+
+func (s *JSONStore) Put(rec ClientRecord) error {
+	s.MemoryStore.Put(rec)
+	return s.flush()
+}
+
+func (s *JSONStore) Delete(identity string) error {
+	s.MemoryStore.Delete(identity)
+	return s.flush()
+}
+
+func (s *JSONStore) AddUsage(deltas []UsageDelta) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	s.MemoryStore.AddUsage(deltas)
+	return s.flush()
+}
+
+// flush writes a snapshot to a temp file and renames it over the old one,
+// so a crash never leaves a half-written store behind
+func (s *JSONStore) flush() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.lock.RLock()
+	data, err := json.MarshalIndent(jsonFile{Clients: s.records, Usage: s.usage}, "", "  ")
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"common"
+	"fmt"
+	"log"
+	"server/config"
+	"time"
+)
+
+// ClientRecord is everything the server remembers about a client across
+// restarts and reconnects, keyed by its stable identity
+type ClientRecord struct {
+	Identity    string                 `json:"identity"`
+	Name        string                 `json:"name"`
+	Phone       string                 `json:"phone"`
+	ProjectName string                 `json:"project_name"`
+	Remark      string                 `json:"remark"`
+	Services    []common.TargetService `json:"services"`
+	Proxies     map[string]int         `json:"proxies,omitempty"` // Dynamic proxy kind -> public port
+	LastSeen    time.Time              `json:"last_seen"`
+	// SHA-256 (hex) of the client secret the identity was first claimed with.
+	// Empty for clients older than client secrets. Never sent to the Web UI.
+	SecretHash string `json:"secret_hash,omitempty"`
+}
+
+// Store persists client records. Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the record for identity, if any
+	Get(identity string) (ClientRecord, bool)
+	// Put creates or replaces a record
+	Put(rec ClientRecord) error
+	// List returns all records
+	List() []ClientRecord
+	// Delete removes the record and usage of identity
+	Delete(identity string) error
+	// AddUsage adds traffic deltas to the per-service totals
+	AddUsage(deltas []UsageDelta) error
+	// Usage returns the totals of identity by service ID
+	Usage(identity string) map[string]Usage
+}
+
+// Traffic is a byte count in both directions, seen from the visitor
+type Traffic struct {
+	In  int64 `json:"in"`  // Visitor -> target
+	Out int64 `json:"out"` // Target -> visitor
+}
+
+// Usage is the traffic of one service by day ("2006-01-02") and month ("2006-01")
+type Usage struct {
+	Daily   map[string]Traffic `json:"daily"`
+	Monthly map[string]Traffic `json:"monthly"`
+}
+
+// UsageDelta is traffic to add to a service's totals for the day of Time
+type UsageDelta struct {
+	Identity  string
+	ServiceID string
+	Time      time.Time
+	Traffic
+}
+
+// UsageDailyRetention is how long daily totals are kept; monthly totals are kept forever
+const UsageDailyRetention = 92 * 24 * time.Hour
+
+// Default is the store used by core, set by Init
+var Default Store = NewMemoryStore()
+
+// Init opens the store selected in config
+func Init() error {
+	cfg := config.GlobalConfig.Store
+	switch cfg.Type {
+	case "", "json":
+		path := cfg.Path
+		if path == "" {
+			path = "data.json"
+		}
+		s, err := OpenJSONStore(path)
+		if err != nil {
+			return err
+		}
+		Default = s
+		log.Printf("[Store] Using JSON store %s (%d clients)", path, len(s.List()))
+	case "memory":
+		Default = NewMemoryStore()
+		log.Println("[Store] Using in-memory store, nothing survives a restart")
+	default:
+		return fmt.Errorf("unknown store type: %s", cfg.Type)
+	}
+	return nil
+}
+
+// ReservedPorts returns public ports assigned to any stored client
+// (online or not), mapped to the owning identity
+func ReservedPorts() map[int]string {
+	ports := make(map[int]string)
+	for _, rec := range Default.List() {
+		for _, svc := range rec.Services {
+			if svc.RemotePort != 0 {
+				ports[svc.RemotePort] = rec.Identity
+			}
+		}
+		for _, port := range rec.Proxies {
+			ports[port] = rec.Identity
+		}
+	}
+	return ports
+}
@@ -0,0 +1,120 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"server/config"
+	"time"
+)
+
+// Default file names used when no certificate is configured.
+// The self-signed pair is generated once and reused, so the fingerprint
+// pinned by clients stays valid across restarts.
+const (
+	defaultCertFile = "server.crt"
+	defaultKeyFile  = "server.key"
+)
+
+// Listen opens the client-facing listener.
+// Unless TLS is disabled in config, every accepted connection is wrapped in TLS
+// before yamux sees it.
+func Listen(port int) (net.Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := config.GlobalConfig.TLS
+	if cfg.Insecure {
+		log.Println("[Transport] WARNING: TLS disabled, client traffic is sent in plaintext")
+		return ln, nil
+	}
+
+	tlsConfig, err := LoadTLSConfig()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// LoadTLSConfig loads the configured certificate, generating a self-signed one if needed
+func LoadTLSConfig() (*tls.Config, error) {
+	cfg := config.GlobalConfig.TLS
+	certFile, keyFile := cfg.CertFile, cfg.KeyFile
+	if certFile == "" && keyFile == "" {
+		certFile, keyFile = defaultCertFile, defaultKeyFile
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			log.Printf("[Transport] No certificate configured, generating self-signed %s / %s", certFile, keyFile)
+			if err := generateSelfSigned(certFile, keyFile); err != nil {
+				return nil, fmt.Errorf("generate self-signed certificate: %v", err)
+			}
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %v", err)
+	}
+
+	// Print the fingerprint so operators can pin it in client config.yaml
+	sum := sha256.Sum256(cert.Certificate[0])
+	log.Printf("[Transport] TLS enabled, certificate SHA-256 fingerprint: %s (set as tls.fingerprint in client config.yaml)", hex.EncodeToString(sum[:]))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func generateSelfSigned(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "fffrp server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, keyPEM, 0600)
+}
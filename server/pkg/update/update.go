@@ -0,0 +1,216 @@
+// Package update hosts signed client builds and serves them to clients over
+// the control stream.
+//
+// Builds live in config update.dir, named by common.UpdateFileName, each with
+// a detached "<file>.sig" holding the base64 ed25519 signature. Sign them with
+// `server -sign-update <file>` using the key from `server -gen-update-key`.
+package update
+
+import (
+	"common"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"server/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// build is a hosted binary with its metadata, cached by modification time
+type build struct {
+	info    common.UpdateInfo
+	path    string
+	modTime time.Time
+}
+
+var (
+	cache     = make(map[string]build) // Path -> Build
+	cacheLock sync.Mutex
+)
+
+func dir() string {
+	if d := config.GlobalConfig.Update.Dir; d != "" {
+		return d
+	}
+	return "updates"
+}
+
+func keyFile() string {
+	if k := config.GlobalConfig.Update.KeyFile; k != "" {
+		return k
+	}
+	return "update.key"
+}
+
+// parseName splits "fffrp-client_<version>_<os>_<arch>[.exe]"
+func parseName(name string) (version, goos, goarch string, ok bool) {
+	base := strings.TrimSuffix(name, ".exe")
+	parts := strings.Split(base, "_")
+	if len(parts) != 4 || parts[0] != "fffrp-client" {
+		return "", "", "", false
+	}
+	if common.UpdateFileName(parts[1], parts[2], parts[3]) != name {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], parts[3], true
+}
+
+// Latest returns the newest signed build for a platform
+func Latest(goos, goarch string) (*common.UpdateInfo, bool) {
+	entries, err := os.ReadDir(dir())
+	if err != nil {
+		return nil, false
+	}
+
+	var best *build
+	for _, e := range entries {
+		version, buildOS, buildArch, ok := parseName(e.Name())
+		if !ok || buildOS != goos || buildArch != goarch {
+			continue
+		}
+		if best != nil && common.CompareVersions(version, best.info.Version) <= 0 {
+			continue
+		}
+		b, err := load(filepath.Join(dir(), e.Name()))
+		if err != nil {
+			log.Printf("[Update] Skipping %s: %v", e.Name(), err)
+			continue
+		}
+		best = &b
+	}
+	if best == nil {
+		return nil, false
+	}
+	info := best.info
+	return &info, true
+}
+
+// load hashes a build and reads its signature, reusing the cache if unchanged
+func load(path string) (build, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return build{}, err
+	}
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if b, ok := cache[path]; ok && b.modTime.Equal(st.ModTime()) {
+		return b, nil
+	}
+
+	sig, err := os.ReadFile(path + ".sig")
+	if err != nil {
+		return build{}, errors.New("not signed")
+	}
+	digest, size, err := hashFile(path)
+	if err != nil {
+		return build{}, err
+	}
+
+	version, goos, goarch, _ := parseName(filepath.Base(path))
+	b := build{
+		info: common.UpdateInfo{
+			Version:   version,
+			OS:        goos,
+			Arch:      goarch,
+			Size:      size,
+			SHA256:    hex.EncodeToString(digest),
+			Signature: strings.TrimSpace(string(sig)),
+		},
+		path:    path,
+		modTime: st.ModTime(),
+	}
+	cache[path] = b
+	return b, nil
+}
+
+func hashFile(path string) ([]byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), size, nil
+}
+
+// ReadChunk serves part of a hosted build
+func ReadChunk(args *common.UpdateChunkArgs) (*common.UpdateChunkReply, error) {
+	name := common.UpdateFileName(args.Version, args.OS, args.Arch)
+	if _, _, _, ok := parseName(name); !ok || filepath.Base(name) != name {
+		return nil, fmt.Errorf("invalid build %s", name)
+	}
+	f, err := os.Open(filepath.Join(dir(), name))
+	if err != nil {
+		return nil, fmt.Errorf("build %s not found", name)
+	}
+	defer f.Close()
+
+	length := args.Length
+	if length <= 0 || length > common.MaxUpdateChunk {
+		length = common.MaxUpdateChunk
+	}
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, args.Offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &common.UpdateChunkReply{Data: buf[:n], EOF: err == io.EOF}, nil
+}
+
+// GenerateKey creates the signing key file and returns the public key (base64)
+// to build into clients
+func GenerateKey() (string, error) {
+	path := keyFile()
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists", path)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(priv)+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// Sign writes "<file>.sig" for a build named by common.UpdateFileName
+func Sign(path string) error {
+	version, goos, goarch, ok := parseName(filepath.Base(path))
+	if !ok {
+		return fmt.Errorf("%s: name must be %s", path, common.UpdateFileName("<version>", "<os>", "<arch>"))
+	}
+	if _, err := common.ParseVersion(version); err != nil {
+		return err
+	}
+
+	keyData, err := os.ReadFile(keyFile())
+	if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(keyData)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%s is not an ed25519 private key", keyFile())
+	}
+
+	digest, _, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(key), common.UpdateSigningMessage(version, goos, goarch, digest))
+	return os.WriteFile(path+".sig", []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0644)
+}
@@ -0,0 +1,118 @@
+package vhost
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"server/config"
+	"server/pkg/core"
+	"strings"
+	"time"
+)
+
+// routeSuffix marks the synthetic upstream host "<service>.<client>.fffrp".
+// Using the route as the upstream address keeps the transport's connection
+// pool separate per service, even if two clients expose the same LAN IP:Port.
+const routeSuffix = ".fffrp"
+
+// StartHTTP starts the shared HTTP entrypoint that routes by Host header:
+// <service>.<client>.<domain> -> service on client
+func StartHTTP() {
+	cfg := config.GlobalConfig.HTTP
+	if cfg.Port == 0 {
+		return
+	}
+	if cfg.Domain == "" {
+		log.Println("[VHost] http.domain not set, HTTP entrypoint disabled")
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: rewrite,
+		Transport: &http.Transport{
+			DialContext:         dialRoute,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[VHost] %s%s: %v", r.Host, r.URL.Path, err)
+			http.Error(w, "fffrp: upstream unavailable: "+err.Error(), http.StatusBadGateway)
+		},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := routeForHost(r.Host, cfg.Domain); !ok {
+			http.Error(w, "fffrp: no service for host "+r.Host, http.StatusNotFound)
+			return
+		}
+		// WebSocket and other upgrades are passed through by ReverseProxy
+		proxy.ServeHTTP(w, r)
+	})
+
+	addr := fmt.Sprintf(":%d", cfg.Port)
+	log.Printf("[VHost] HTTP entrypoint on %s for *.%s", addr, cfg.Domain)
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			log.Printf("[VHost] HTTP entrypoint stopped: %v", err)
+		}
+	}()
+}
+
+// routeForHost splits "<service>.<client>.<domain>[:port]" into its labels
+func routeForHost(host, domain string) (clientLabel, serviceLabel string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	suffix := "." + strings.ToLower(domain)
+	if !strings.HasSuffix(host, suffix) {
+		return "", "", false
+	}
+	prefix := strings.TrimSuffix(host, suffix)
+
+	dot := strings.LastIndexByte(prefix, '.')
+	if dot <= 0 || dot == len(prefix)-1 {
+		return "", "", false
+	}
+	return prefix[dot+1:], prefix[:dot], true
+}
+
+func rewrite(pr *httputil.ProxyRequest) {
+	clientLabel, serviceLabel, _ := routeForHost(pr.In.Host, config.GlobalConfig.HTTP.Domain)
+	_, svc, found := core.FindServiceByLabel(clientLabel, serviceLabel)
+
+	pr.Out.URL.Scheme = "http"
+	pr.Out.URL.Host = serviceLabel + "." + clientLabel + routeSuffix
+	pr.SetXForwarded() // X-Forwarded-For/-Host/-Proto
+
+	// Keep the visitor's Host unless the service asks for a rewrite
+	pr.Out.Host = pr.In.Host
+	if found && svc.HostRewrite != "" {
+		pr.Out.Host = svc.HostRewrite
+	}
+}
+
+// dialRoute opens a data stream for the synthetic upstream host built in rewrite
+func dialRoute(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	route := strings.TrimSuffix(host, routeSuffix)
+	dot := strings.LastIndexByte(route, '.')
+	if dot < 0 {
+		return nil, fmt.Errorf("bad route %s", addr)
+	}
+
+	clientID, svc, found := core.FindServiceByLabel(route[dot+1:], route[:dot])
+	if !found {
+		return nil, fmt.Errorf("service %s not found", route)
+	}
+	// Upstream connections are pooled across visitors, so a PROXY header can only say "unknown";
+	// X-Forwarded-For carries the real address here
+	return core.DialService(clientID, svc, nil)
+}
@@ -0,0 +1,27 @@
+package vhost
+
+import "testing"
+
+func TestRouteForHost(t *testing.T) {
+	tests := []struct {
+		host           string
+		client, server string
+		ok             bool
+	}{
+		{"web.box1.example.com", "box1", "web", true},
+		{"web.box1.example.com:8080", "box1", "web", true},
+		{"WEB.Box1.Example.COM.", "box1", "web", true},
+		{"a.b.web.box1.example.com", "box1", "a.b.web", true},
+		{"box1.example.com", "", "", false},
+		{".box1.example.com", "", "", false},
+		{"web.box1.other.com", "", "", false},
+		{"web.box1.notexample.com", "", "", false},
+		{"example.com", "", "", false},
+	}
+	for _, tt := range tests {
+		client, service, ok := routeForHost(tt.host, "example.com")
+		if client != tt.client || service != tt.server || ok != tt.ok {
+			t.Errorf("routeForHost(%q) = %q, %q, %v, want %q, %q, %v", tt.host, client, service, ok, tt.client, tt.server, tt.ok)
+		}
+	}
+}
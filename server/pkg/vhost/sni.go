@@ -0,0 +1,135 @@
+package vhost
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"server/config"
+	"server/pkg/core"
+	"time"
+)
+
+// clientHelloTimeout bounds how long a visitor may take to send its ClientHello
+const clientHelloTimeout = 10 * time.Second
+
+// errHelloRead aborts the fake handshake once the ClientHello is parsed
+var errHelloRead = errors.New("client hello read")
+
+// StartTLS starts the TLS passthrough entrypoint. It reads the SNI from the
+// ClientHello and forwards the raw stream, so the target keeps its own
+// certificate and the server never decrypts anything.
+func StartTLS() {
+	cfg := config.GlobalConfig.HTTPS
+	if cfg.Port == 0 {
+		return
+	}
+	domain := cfg.Domain
+	if domain == "" {
+		domain = config.GlobalConfig.HTTP.Domain
+	}
+	if domain == "" {
+		log.Println("[VHost] https.domain not set, TLS entrypoint disabled")
+		return
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		log.Printf("[VHost] Failed to listen on TLS port %d: %v", cfg.Port, err)
+		return
+	}
+	log.Printf("[VHost] TLS passthrough entrypoint on :%d for *.%s", cfg.Port, domain)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("[VHost] TLS entrypoint stopped: %v", err)
+				return
+			}
+			go handleTLSConn(conn, domain)
+		}
+	}()
+}
+
+func handleTLSConn(conn net.Conn, domain string) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	sni, hello, err := peekSNI(conn)
+	if err != nil {
+		log.Printf("[VHost] %s: failed to read ClientHello: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	clientLabel, serviceLabel, ok := routeForHost(sni, domain)
+	if !ok {
+		log.Printf("[VHost] %s: no route for SNI %q", conn.RemoteAddr(), sni)
+		conn.Close()
+		return
+	}
+	clientID, svc, found := core.FindServiceByLabel(clientLabel, serviceLabel)
+	if !found {
+		log.Printf("[VHost] %s: no service for SNI %q", conn.RemoteAddr(), sni)
+		conn.Close()
+		return
+	}
+
+	stream, err := core.DialService(clientID, svc, conn)
+	if err != nil {
+		log.Printf("[VHost] SNI %s: data stream to client %s failed: %v", sni, clientID, err)
+		conn.Close()
+		return
+	}
+
+	// Replay the ClientHello we consumed, then pipe raw bytes
+	if _, err := stream.Write(hello); err != nil {
+		stream.Close()
+		conn.Close()
+		return
+	}
+	go func() {
+		io.Copy(conn, stream)
+		conn.Close()
+	}()
+	go func() {
+		io.Copy(stream, conn)
+		stream.Close()
+	}()
+}
+
+// peekSNI runs the ClientHello through crypto/tls's parser and returns the
+// server name together with every byte read, for replay to the target
+func peekSNI(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var sni string
+
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, &buf), Conn: conn}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	if sni == "" {
+		if err == nil || errors.Is(err, errHelloRead) {
+			err = errors.New("no SNI in ClientHello")
+		}
+		return "", nil, err
+	}
+	return sni, buf.Bytes(), nil
+}
+
+// readOnlyConn feeds tls.Server from a reader and swallows its writes,
+// so the aborted fake handshake sends nothing to the visitor
+type readOnlyConn struct {
+	r io.Reader
+	net.Conn
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                { return nil }
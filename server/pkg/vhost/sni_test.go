@@ -0,0 +1,58 @@
+package vhost
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestPeekSNI(t *testing.T) {
+	tests := []struct {
+		serverName string
+		want       string // Empty: no SNI expected
+	}{
+		{"web.box1.example.com", "web.box1.example.com"},
+		{"localhost", "localhost"},
+		{"10.0.0.1", ""}, // IP addresses are never sent as SNI
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			visitor, conn := net.Pipe()
+			defer conn.Close()
+			go func() {
+				tls.Client(visitor, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}).Handshake()
+				visitor.Close()
+			}()
+
+			sni, hello, err := peekSNI(conn)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("got SNI %q, want an error", sni)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sni != tt.want {
+				t.Errorf("SNI = %q, want %q", sni, tt.want)
+			}
+			// The replayed bytes must be the whole ClientHello record
+			if len(hello) < 5 || hello[0] != 0x16 || len(hello) != 5+int(hello[3])<<8+int(hello[4]) {
+				t.Errorf("replay is not one handshake record: % x", hello[:min(len(hello), 8)])
+			}
+		})
+	}
+}
+
+func TestPeekSNINotTLS(t *testing.T) {
+	visitor, conn := net.Pipe()
+	defer conn.Close()
+	go func() {
+		visitor.Write([]byte("GET / HTTP/1.1\r\nHost: web.box1.example.com\r\n\r\n"))
+		visitor.Close()
+	}()
+	if sni, _, err := peekSNI(conn); err == nil {
+		t.Errorf("plain HTTP gave SNI %q", sni)
+	}
+}
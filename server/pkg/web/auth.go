@@ -0,0 +1,113 @@
+package web
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"server/config"
+	"server/pkg/auth"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const sessionCookie = "fffrp_session"
+
+// loginLimiter locks out an address after too many wrong passwords
+var loginLimiter = auth.NewLimiter(5, 15*time.Minute)
+
+// requireRole rejects requests without a session granting the given role.
+// Token is taken from "Authorization: Bearer" or the session cookie (also sent with the
+// WebSocket upgrade). Never from the query string, which ends up in access logs.
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := auth.Lookup(requestToken(c))
+		if s == nil {
+			c.AbortWithStatusJSON(401, gin.H{"error": "login required"})
+			return
+		}
+		if !auth.HasRole(s.Role, role) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "forbidden: requires " + role})
+			return
+		}
+		c.Set("session", s)
+		c.Next()
+	}
+}
+
+// requireMetricsToken guards /metrics with metrics.token, if configured.
+// Prometheus sends it as "Authorization: Bearer" (bearer_token in the scrape config).
+func requireMetricsToken(c *gin.Context) {
+	want := config.GlobalConfig.Metrics.Token
+	if want == "" {
+		c.Next()
+		return
+	}
+	got := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Next()
+}
+
+func requestToken(c *gin.Context) string {
+	if h := c.GetHeader("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	if cookie, err := c.Cookie(sessionCookie); err == nil {
+		return cookie
+	}
+	return ""
+}
+
+func login(c *gin.Context) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	// RemoteAddr, not ClientIP: a forwarded header is whatever the attacker sends
+	addr := c.Request.RemoteAddr
+	if !loginLimiter.Allowed(addr) {
+		c.JSON(429, gin.H{"error": "too many failed logins, try again later"})
+		return
+	}
+
+	s, err := auth.Login(req.Username, req.Password)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			loginLimiter.Fail(addr)
+		}
+		c.JSON(401, gin.H{"error": err.Error()})
+		return
+	}
+	loginLimiter.Succeed(addr)
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.Token,
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	c.JSON(200, gin.H{"token": s.Token, "username": s.Username, "role": s.Role})
+}
+
+func logout(c *gin.Context) {
+	auth.Logout(requestToken(c))
+	http.SetCookie(c.Writer, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	c.JSON(200, gin.H{"status": "logged out"})
+}
+
+func me(c *gin.Context) {
+	s := c.MustGet("session").(*auth.Session)
+	c.JSON(200, gin.H{"username": s.Username, "role": s.Role})
+}
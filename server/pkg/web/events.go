@@ -0,0 +1,179 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"server/pkg/core"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// The Web UI follows changes over /ws, one JSON event per message:
+//
+//	{"seq": 42, "type": "client_connected", "time": "...", "data": {...}}
+//
+// Event types and payloads are the core.Event* constants, with client_connected
+// and client_updated carrying a full ClientDTO. The last eventBufferSize events
+// are kept, so a browser that reconnects with ?since=<seq>&epoch=<epoch> only
+// gets what it missed. Otherwise (first connect, too far behind, server restarted)
+// it gets a "resync" event and must refetch /api/clients.
+// traffic_tick events are ephemeral: no seq, never replayed.
+
+const (
+	eventResync     = "resync" // seq: current position, data: {"epoch": ...}
+	eventBufferSize = 1000
+	eventQueueSize  = 1024
+	wsWriteTimeout  = 5 * time.Second
+)
+
+type wsEvent struct {
+	Seq  uint64      `json:"seq,omitempty"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+var (
+	wsConns = make(map[*websocket.Conn]bool)
+	wsLock  sync.Mutex // Guards wsConns, the ring and all socket writes
+
+	eventRing [eventBufferSize][]byte // Encoded event with seq s at s % eventBufferSize
+	lastSeq   uint64
+
+	// epoch tells a resuming browser whether seq numbers are still ours
+	epoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	// Core events wait here for the broadcaster, so a slow browser never
+	// holds up the goroutine that emitted them
+	eventQueue = make(chan wsEvent, eventQueueSize)
+	overflowed atomic.Bool
+)
+
+func init() {
+	go broadcastLoop()
+}
+
+// publishCoreEvent is core.OnEvent: resolves client payloads and queues the event
+func publishCoreEvent(event string, data interface{}) {
+	switch event {
+	case core.EventClientConnected, core.EventClientUpdated:
+		ref := data.(core.ClientEvent)
+		core.ClientsLock.RLock()
+		client, ok := core.Clients[ref.ID]
+		if ok {
+			data = newClientDTO(client)
+		}
+		core.ClientsLock.RUnlock()
+		if !ok {
+			return // Gone already, client_disconnected follows
+		}
+	}
+
+	select {
+	case eventQueue <- wsEvent{Type: event, Time: time.Now(), Data: data}:
+	default:
+		// Dropping would leave a gap in seq, make every browser start over instead
+		overflowed.Store(true)
+	}
+}
+
+func broadcastLoop() {
+	for ev := range eventQueue {
+		wsLock.Lock()
+		if overflowed.Swap(false) {
+			log.Println("[Web] Event queue overflowed, asking browsers to resync")
+			lastSeq += eventBufferSize // Nothing before this can be replayed
+			writeAll(resyncEvent())
+		}
+		if ev.Type != core.EventTrafficTick {
+			lastSeq++
+			ev.Seq = lastSeq
+		}
+		msg, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("[Web] Failed to encode %s event: %v", ev.Type, err)
+		} else {
+			if ev.Seq != 0 {
+				eventRing[ev.Seq%eventBufferSize] = msg
+			}
+			writeAll(msg)
+		}
+		wsLock.Unlock()
+	}
+}
+
+// resyncEvent tells a browser to refetch everything. Caller must hold wsLock.
+func resyncEvent() []byte {
+	msg, _ := json.Marshal(wsEvent{Seq: lastSeq, Type: eventResync, Time: time.Now(), Data: gin.H{"epoch": epoch}})
+	return msg
+}
+
+// writeAll sends msg to every socket, dropping the ones that fail. Caller must hold wsLock.
+func writeAll(msg []byte) {
+	for conn := range wsConns {
+		if err := writeWS(conn, msg); err != nil {
+			conn.Close()
+			delete(wsConns, conn)
+		}
+	}
+}
+
+func writeWS(conn *websocket.Conn, msg []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// replayable reports whether every event after since is still buffered. Caller must hold wsLock.
+func replayable(since uint64, sinceEpoch string) bool {
+	return sinceEpoch == epoch && since <= lastSeq && lastSeq-since < eventBufferSize
+}
+
+// Default CheckOrigin only allows same-origin browsers
+var upgrader = websocket.Upgrader{}
+
+func wsHandler(c *gin.Context) {
+	since, sinceErr := strconv.ParseUint(c.Query("since"), 10, 64)
+	sinceEpoch := c.Query("epoch")
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+
+	// Catch up and register under one lock, so no event is missed or sent twice
+	wsLock.Lock()
+	if sinceErr == nil && replayable(since, sinceEpoch) {
+		for seq := since + 1; seq <= lastSeq && err == nil; seq++ {
+			err = writeWS(conn, eventRing[seq%eventBufferSize])
+		}
+	} else {
+		err = writeWS(conn, resyncEvent())
+	}
+	if err == nil {
+		wsConns[conn] = true
+	}
+	wsLock.Unlock()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	defer func() {
+		wsLock.Lock()
+		delete(wsConns, conn)
+		wsLock.Unlock()
+		conn.Close()
+	}()
+
+	// Nothing is expected from the browser, reading only notices the close
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
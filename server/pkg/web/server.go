@@ -2,57 +2,66 @@ package web
 
 import (
 	"common"
+	"common/jsonrpc"
+	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
 	"server/config"
+	"server/pkg/auth"
 	"server/pkg/core"
-
-	"sync"
+	"server/pkg/metrics"
+	"server/pkg/store"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 )
 
 //go:embed dist/*
 var content embed.FS
 
-var (
-	wsConns = make(map[*websocket.Conn]bool)
-	wsLock  sync.Mutex
-)
-
 func Start() {
 	r := gin.Default()
 
 	// Register Core Callback
-	core.OnClientUpdate = func() {
-		broadcastUpdate()
-	}
+	core.OnEvent = publishCoreEvent
 
-	// Enable CORS
-	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	// No CORS: the admin UI is served from this origin, and cookies are SameSite=Strict
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		c.Next()
-	})
+	r.POST("/api/login", login)
+	r.POST("/api/logout", logout)
 
-	api := r.Group("/api")
+	viewer := r.Group("/api", requireRole(auth.RoleViewer))
 	{
-		api.GET("/clients", getClients)
-		api.POST("/client/:id/service", addService)
-		api.DELETE("/client/:id/service/:service_id", removeService)
+		viewer.GET("/me", me)
+		viewer.GET("/clients", getClients)
+		viewer.GET("/history", getHistory)
+		viewer.GET("/connections", getConnections)
+		viewer.GET("/client/:id/usage", getUsage)
 	}
 
+	operator := r.Group("/api", requireRole(auth.RoleOperator))
+	{
+		operator.POST("/client/:id/service", addService)
+		operator.PUT("/client/:id/service/:service_id", updateService)
+		operator.DELETE("/client/:id/service/:service_id", removeService)
+		operator.POST("/client/:id/proxy/:kind", startProxy)
+		operator.DELETE("/client/:id/proxy/:kind", stopProxy)
+		operator.POST("/client/:id/disconnect", disconnectClient)
+		operator.DELETE("/history/:identity", forgetClient)
+		operator.DELETE("/connections/:id", closeConnection)
+	}
+
+	// Prometheus scrape endpoint, optionally behind its own bearer token
+	r.GET("/metrics", requireMetricsToken, gin.WrapH(metrics.Handler()))
+
 	// WebSocket for real-time updates to Web UI
-	r.GET("/ws", wsHandler)
+	r.GET("/ws", requireRole(auth.RoleViewer), wsHandler)
 
 	// Serve Static Files (Embedded)
 	distFS, _ := fs.Sub(content, "dist")
@@ -76,33 +85,171 @@ func Start() {
 	go r.Run(addr)
 }
 
+// ClientDTO is a connected client as the Web UI sees it
+type ClientDTO struct {
+	ID          string `json:"id"`
+	Identity    string `json:"identity"`
+	Name        string `json:"name"`
+	Phone       string `json:"phone"`
+	ProjectName string `json:"project_name"`
+	Remark      string `json:"remark"`
+	Version     string `json:"version"`
+	// Features enabled for this session (negotiated in the handshake)
+	Capabilities []string               `json:"capabilities"`
+	Services     []common.TargetService `json:"services"`
+	// Last data stream failure per service ID
+	StreamErrors map[string]core.StreamError `json:"stream_errors"`
+	LastSeen     time.Time                   `json:"last_seen"`
+	RTTMs        int64                       `json:"rtt_ms"`
+	MissedBeats  int                         `json:"missed_beats"`
+	// Virtual host per service ID, when the HTTP entrypoint is enabled
+	HTTPHosts map[string]string `json:"http_hosts,omitempty"`
+	// Dynamic proxies: kind -> public port
+	Proxies map[string]int `json:"proxies"`
+	// Service IDs the client's user has not approved yet, these are not forwarded
+	PendingApproval []string `json:"pending_approval,omitempty"`
+}
+
+// newClientDTO snapshots a client. Caller must hold core.ClientsLock.
+func newClientDTO(client *core.ClientSession) ClientDTO {
+	var httpHosts map[string]string
+	if cfg := config.GlobalConfig.HTTP; cfg.Port != 0 && cfg.Domain != "" {
+		httpHosts = make(map[string]string)
+		for _, svc := range client.Services {
+			if svc.Proto() == common.ProtocolTCP {
+				httpHosts[svc.ID] = fmt.Sprintf("%s.%s.%s", core.ServiceLabel(svc), core.Label(client.Identity), cfg.Domain)
+			}
+		}
+	}
+	streamErrors := make(map[string]core.StreamError, len(client.StreamErrors))
+	for id, e := range client.StreamErrors {
+		streamErrors[id] = e
+	}
+	proxies := make(map[string]int, len(client.Proxies))
+	for kind, port := range client.Proxies {
+		proxies[kind] = port
+	}
+	return ClientDTO{
+		ID:           client.ID,
+		Identity:     client.Identity,
+		Name:         client.Name,
+		Phone:        client.Phone,
+		ProjectName:  client.ProjectName,
+		Remark:       client.Remark,
+		Version:      client.Version,
+		Capabilities: client.Capabilities,
+		Services:     append([]common.TargetService{}, client.Services...),
+		StreamErrors: streamErrors,
+		LastSeen:     client.LastSeen,
+		RTTMs:        client.RTTMs,
+		MissedBeats:  client.MissedBeats,
+		HTTPHosts:    httpHosts,
+		Proxies:      proxies,
+
+		PendingApproval: client.Unapproved,
+	}
+}
+
 func getClients(c *gin.Context) {
 	core.ClientsLock.RLock()
 	defer core.ClientsLock.RUnlock()
 
 	// Convert map to list for JSON
-	type ClientDTO struct {
-		ID          string                 `json:"id"`
-		Name        string                 `json:"name"`
-		Phone       string                 `json:"phone"`
-		ProjectName string                 `json:"project_name"`
-		Remark      string                 `json:"remark"`
-		Services    []common.TargetService `json:"services"`
-	}
 	list := []ClientDTO{}
 	for _, client := range core.Clients {
-		list = append(list, ClientDTO{
-			ID:          client.ID,
-			Name:        client.Name,
-			Phone:       client.Phone,
-			ProjectName: client.ProjectName,
-			Remark:      client.Remark,
-			Services:    client.Services,
-		})
+		list = append(list, newClientDTO(client))
+	}
+	c.JSON(200, list)
+}
+
+// getHistory lists every client identity the server has seen, online or not
+func getHistory(c *gin.Context) {
+	core.ClientsLock.RLock()
+	online := make(map[string]bool)
+	for _, client := range core.Clients {
+		online[client.Identity] = true
+	}
+	core.ClientsLock.RUnlock()
+
+	type HistoryDTO struct {
+		store.ClientRecord
+		Online bool `json:"online"`
 	}
+	list := []HistoryDTO{}
+	for _, rec := range store.Default.List() {
+		rec.SecretHash = ""
+		list = append(list, HistoryDTO{ClientRecord: rec, Online: online[rec.Identity]})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
 	c.JSON(200, list)
 }
 
+// forgetClient deletes the stored services and ports of an offline client,
+// so its reserved ports can be given to others
+func forgetClient(c *gin.Context) {
+	if err := core.ForgetIdentity(c.Param("identity")); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "client forgotten"})
+}
+
+// getConnections lists active visitor connections, optionally ?client=<id>
+func getConnections(c *gin.Context) {
+	c.JSON(200, core.ListConnections(c.Query("client")))
+}
+
+// closeConnection kills one visitor connection
+func closeConnection(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid connection id"})
+		return
+	}
+	if err := core.CloseConnection(id); err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "connection closed"})
+}
+
+// disconnectClient closes a client session. Body {"reason": "..."} is optional
+// and shown to the user of the client.
+func disconnectClient(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "Disconnected by " + c.MustGet("session").(*auth.Session).Username
+	}
+
+	if err := core.DisconnectClient(c.Param("id"), req.Reason); err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "client disconnected"})
+}
+
+// getUsage returns daily and monthly traffic per service of a client.
+// id is a session ID or, for offline clients, an identity from /api/history.
+func getUsage(c *gin.Context) {
+	identity := c.Param("id")
+	core.ClientsLock.RLock()
+	if client, ok := core.Clients[identity]; ok {
+		identity = client.Identity
+	}
+	core.ClientsLock.RUnlock()
+
+	// Include traffic of open connections since the last periodic flush
+	core.FlushUsage()
+	c.JSON(200, store.Default.Usage(identity))
+}
+
 func addService(c *gin.Context) {
 	clientID := c.Param("id")
 	var svc common.TargetService
@@ -123,9 +270,16 @@ func addService(c *gin.Context) {
 		if svc.ID == "" {
 			svc.ID = fmt.Sprintf("svc-%d", port)
 		}
-	} else if svc.ID == "" {
-		// Even if port is provided (unlikely from UI but possible), ensure ID
-		svc.ID = fmt.Sprintf("svc-%d", svc.RemotePort)
+	} else {
+		// A chosen port must be free, UpdateServices would otherwise hand out another
+		if err := core.PortUsable(clientID, svc.RemotePort); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if svc.ID == "" {
+			// Even if port is provided (unlikely from UI but possible), ensure ID
+			svc.ID = fmt.Sprintf("svc-%d", svc.RemotePort)
+		}
 	}
 
 	core.ClientsLock.RLock()
@@ -136,7 +290,7 @@ func addService(c *gin.Context) {
 		return
 	}
 
-	if client.RPCClient == nil {
+	if client.Peer == nil {
 		core.ClientsLock.RUnlock()
 		c.JSON(500, gin.H{"error": "client rpc not ready"})
 		return
@@ -145,7 +299,7 @@ func addService(c *gin.Context) {
 	// Copy services to avoid race during RPC call
 	currentServices := make([]common.TargetService, len(client.Services))
 	copy(currentServices, client.Services)
-	rpcClient := client.RPCClient
+	peer := client.Peer
 	core.ClientsLock.RUnlock()
 
 	// Update core services first to reflect the allocated port!
@@ -165,6 +319,16 @@ func addService(c *gin.Context) {
 	// Let's assume UI uses the ID returned by getClients, which IS the full ID.
 	core.UpdateServices(clientID, newServices)
 
+	// Push what the core ended up with, a port taken meanwhile was replaced
+	core.ClientsLock.RLock()
+	newServices = append([]common.TargetService{}, client.Services...)
+	core.ClientsLock.RUnlock()
+	for _, s := range newServices {
+		if s.ID == svc.ID {
+			svc = s
+		}
+	}
+
 	// Call Client RPC
 	args := &common.PushConfigArgs{
 		Services: newServices, // Send full list or delta?
@@ -173,15 +337,14 @@ func addService(c *gin.Context) {
 		// But usually `PushConfig` implies "Here is your config".
 		// In `addService` before, it appended.
 	}
-	var reply common.BaseReply
-	err := rpcClient.Call("ClientRPC.PushConfig", args, &reply)
+	pending, err := pushConfig(c, clientID, peer, args)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "rpc call failed: " + err.Error()})
 		// Rollback?
 		return
 	}
 
-	c.JSON(200, gin.H{"status": "pushed to client", "service": svc})
+	c.JSON(200, gin.H{"status": "pushed to client", "service": svc, "pending_approval": slices.Contains(pending, svc.ID)})
 }
 
 func removeService(c *gin.Context) {
@@ -196,7 +359,7 @@ func removeService(c *gin.Context) {
 		return
 	}
 
-	if client.RPCClient == nil {
+	if client.Peer == nil {
 		core.ClientsLock.RUnlock()
 		c.JSON(500, gin.H{"error": "client rpc not ready"})
 		return
@@ -205,7 +368,7 @@ func removeService(c *gin.Context) {
 	// Copy services
 	currentServices := make([]common.TargetService, len(client.Services))
 	copy(currentServices, client.Services)
-	rpcClient := client.RPCClient
+	peer := client.Peer
 	core.ClientsLock.RUnlock()
 
 	// Filter services
@@ -220,9 +383,7 @@ func removeService(c *gin.Context) {
 	args := &common.PushConfigArgs{
 		Services: newServices,
 	}
-	var reply common.BaseReply
-	err := rpcClient.Call("ClientRPC.PushConfig", args, &reply)
-	if err != nil {
+	if _, err := pushConfig(c, clientID, peer, args); err != nil {
 		c.JSON(500, gin.H{"error": "rpc call failed: " + err.Error()})
 		return
 	}
@@ -238,45 +399,90 @@ func removeService(c *gin.Context) {
 	c.JSON(200, gin.H{"status": "removed, pushed to client"})
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
+// updateService edits a service in place. The body is the full service;
+// remote_port 0 keeps the current port. Visitors already connected stay on
+// their streams, new ones get the new target and port.
+func updateService(c *gin.Context) {
+	clientID := c.Param("id")
+	var svc common.TargetService
+	if err := c.BindJSON(&svc); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	svc.ID = c.Param("service_id")
 
-func wsHandler(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	svc, err := core.UpdateService(clientID, svc)
 	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 
-	wsLock.Lock()
-	wsConns[conn] = true
-	wsLock.Unlock()
-
-	defer func() {
-		conn.Close()
-		wsLock.Lock()
-		delete(wsConns, conn)
-		wsLock.Unlock()
-	}()
+	core.ClientsLock.RLock()
+	client, exists := core.Clients[clientID]
+	if !exists {
+		core.ClientsLock.RUnlock()
+		c.JSON(404, gin.H{"error": "client not found"})
+		return
+	}
+	args := &common.PushConfigArgs{
+		Services: append([]common.TargetService{}, client.Services...),
+	}
+	peer := client.Peer
+	core.ClientsLock.RUnlock()
 
-	// Simple loop
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			break
-		}
+	pending, err := pushConfig(c, clientID, peer, args)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "updated on server, but rpc call failed: " + err.Error()})
+		return
 	}
+	c.JSON(200, gin.H{"status": "updated, pushed to client", "service": svc, "pending_approval": slices.Contains(pending, svc.ID)})
 }
 
-func broadcastUpdate() {
-	wsLock.Lock()
-	defer wsLock.Unlock()
+// pushConfigTimeout bounds how long a web request waits for the client to apply a push
+const pushConfigTimeout = 10 * time.Second
 
-	for conn := range wsConns {
-		err := conn.WriteMessage(websocket.TextMessage, []byte("update"))
-		if err != nil {
-			conn.Close()
-			delete(wsConns, conn)
+// pushConfig sends the client its new service list and waits for the ack.
+// Gives up when the browser goes away or the client does not answer in time.
+// Returns the service IDs the client's user still has to approve.
+func pushConfig(c *gin.Context, clientID string, peer *jsonrpc.Peer, args *common.PushConfigArgs) ([]string, error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), pushConfigTimeout)
+	defer cancel()
+
+	var reply common.PushConfigReply
+	if err := peer.Call(ctx, common.MethodPushConfig, args, &reply); err != nil {
+		return nil, err
+	}
+	if !reply.Success {
+		return nil, errors.New(reply.Message)
+	}
+	core.SetUnapproved(clientID, reply.Unapproved)
+	return reply.Unapproved, nil
+}
+
+// startProxy opens (or moves) a dynamic proxy such as SOCKS5 for a client.
+// Body {"port": N} is optional, 0 allocates a port.
+func startProxy(c *gin.Context) {
+	var req struct {
+		Port int `json:"port"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&req); err != nil {
+			return
 		}
 	}
+
+	port, err := core.StartProxy(c.Param("id"), c.Param("kind"), req.Port)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "proxy started", "port": port})
+}
+
+func stopProxy(c *gin.Context) {
+	if err := core.StopProxy(c.Param("id"), c.Param("kind")); err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "proxy stopped"})
 }
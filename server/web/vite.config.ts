@@ -7,5 +7,12 @@ export default defineConfig({
   build: {
     outDir: '../pkg/web/dist',
     emptyOutDir: true,
+  },
+  server: {
+    // The API is same-origin only, so proxy it during development
+    proxy: {
+      '/api': 'http://127.0.0.1:8080',
+      '/ws': { target: 'ws://127.0.0.1:8080', ws: true },
+    }
   }
 })